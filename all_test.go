@@ -4,7 +4,14 @@ import (
 	"context"
 	"errors"
 	"fmt"
+	"io"
+	"log/slog"
+	"math"
+	"math/rand"
+	"reflect"
+	"runtime"
 	"slices"
+	"sync"
 	"testing"
 	"time"
 )
@@ -17,9 +24,32 @@ func TestInvalidConfig(t *testing.T) {
 	for _, config := range []Config{
 		{},
 		{Delay: s, Scale: 0.9},
+		{AllowZeroDelay: true},
 		{Delay: s, Scale: -0.1},
 		{Delay: s, Jitter: -0.1},
 		{Delay: s, Jitter: 1.1},
+		{Delay: s, MaxJitterAbsolute: -s},
+		{Delay: s, MaxDelayJitter: -s},
+		{Delay: s, FirstDelay: -s},
+		{Delay: s, MaxConsecutiveSameError: -1},
+		{Delay: s, MaxTotalAttempts: -1},
+		{Delay: s, JitterFloorFraction: -0.1},
+		{Delay: s, JitterAttempts: -1},
+		{Delay: s, JitterFloorFraction: 0.2},
+		{Delay: s, Jitter: 0.5, JitterFloorFraction: 0.6},
+		{Delay: s, Jitter: NoJitter, JitterFloorFraction: 0.1},
+		{Delay: s, LogSampleEvery: -1},
+		{Delay: s, FirstDelay: 2 * s, MaxDelay: s},
+		{Delay: 2 * s, MaxDelay: s, StrictValidate: true},
+		{Delay: s, Heartbeat: Heartbeat{Fn: func(time.Duration) {}}},
+		{Delay: s, Group: &Group{}},
+		{Delay: s, StopAtMaxDelay: true},
+		{Delay: s, MaxDelay: s, StopAtMaxDelay: true, MaxDelayStreak: -1},
+		{BackoffSchedule: []BackoffPhase{}},
+		{BackoffSchedule: []BackoffPhase{{}}},
+		{BackoffSchedule: []BackoffPhase{{Delay: s, Scale: 0.9}}},
+		{BackoffSchedule: []BackoffPhase{{Delay: s, Attempts: -1}}},
+		{BackoffSchedule: []BackoffPhase{{Delay: s}, {Delay: s}}},
 	} {
 		t.Run(fmt.Sprint(config), func(t *testing.T) {
 			var fnCalled bool
@@ -33,10 +63,27 @@ func TestInvalidConfig(t *testing.T) {
 			if err == nil {
 				t.Fatalf("nil returned on invalid config")
 			}
+			if validateErr := config.Validate(); validateErr == nil || validateErr.Error() != err.Error() {
+				t.Fatalf("Validate was supposed to return %v, returned %v", err, validateErr)
+			}
 		})
 	}
 }
 
+func TestValidConfig(t *testing.T) {
+	s := time.Second
+	for _, config := range []Config{
+		{Delay: s},
+		{Delay: s, Scale: 1.5, Jitter: NoJitter},
+		{Delay: s, Jitter: 1, MaxJitterAbsolute: s, MaxDelayJitter: s},
+		{BackoffSchedule: []BackoffPhase{{Delay: s, Attempts: 1}, {Delay: s}}},
+	} {
+		if err := config.Validate(); err != nil {
+			t.Errorf("Validate was supposed to accept %v, returned %v", config, err)
+		}
+	}
+}
+
 func timeAfterCancelOn100Hours(cancel func()) func(time.Duration) <-chan time.Time {
 	return func(d time.Duration) <-chan time.Time {
 		ch := time.After(d)
@@ -89,6 +136,22 @@ func TestCancel(t *testing.T) {
 			t.Fatalf("Do was supposed to return successfully, returned %v", err)
 		}
 	})
+	t.Run("before first attempt", func(t *testing.T) {
+		ctx, done := context.WithCancel(context.Background())
+		done()
+
+		var fnCalled bool
+		err := Do(ctx, Config{Delay: time.Nanosecond}, func(ctx context.Context) error {
+			fnCalled = true
+			return nil
+		})
+		if fnCalled {
+			t.Fatalf("fn called when context is cancelled before Do")
+		}
+		if !errors.Is(err, context.Canceled) {
+			t.Fatalf("Do was supposed to return 'canceled' error, returned %v", err)
+		}
+	})
 	t.Run("while in pre delay", func(t *testing.T) {
 		ctx, done := context.WithCancel(context.Background())
 		defer done()
@@ -216,10 +279,62 @@ func TestDelays(t *testing.T) {
 	}
 }
 
+// manualClock is a fake clock for Do: delays pass instantly, advancing the
+// clock, and fire the timeout they cross
+type manualClock struct {
+	mu sync.Mutex
+	t  time.Time
+
+	// Do runs a single Timeout at a time, so only the latest timer matters
+	timerAt time.Time
+	timer   chan time.Time
+}
+
+func newManualClock() *manualClock {
+	return &manualClock{t: time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)}
+}
+
+func (c *manualClock) now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.t
+}
+
+// after is a timer firing once the clock reaches d from now
+func (c *manualClock) after(d time.Duration) <-chan time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.timerAt = c.t.Add(d)
+	c.timer = make(chan time.Time, 1)
+	return c.timer
+}
+
+// sleep advances the clock by d. If that fires the timer, the returned
+// channel never fires, as the timer comes first.
+func (c *manualClock) sleep(d time.Duration) <-chan time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.t = c.t.Add(d)
+	if c.timer != nil && !c.timerAt.After(c.t) {
+		c.timer <- c.t
+		c.timer = nil
+		return nil
+	}
+	ch := make(chan time.Time, 1)
+	ch <- c.t
+	return ch
+}
+
+func (c *manualClock) config(cfg Config) Config {
+	cfg.timeAfter = c.sleep
+	cfg.timeoutAfter = c.after
+	cfg.now = c.now
+	return cfg
+}
+
 func TestResetTimeout(t *testing.T) {
-	// TODO: this test will fail if fn() actually takes more than one millisecond.
-	// Do we care?
-	cfg := Config{Timeout: time.Millisecond, Delay: 50 * time.Microsecond}
+	clock := newManualClock()
+	cfg := clock.config(Config{Timeout: time.Millisecond, Delay: 50 * time.Microsecond, Jitter: NoJitter})
 	var fnCalled int
 	err := Do(context.Background(), cfg, func(ctx context.Context) error {
 		fnCalled++
@@ -236,6 +351,29 @@ func TestResetTimeout(t *testing.T) {
 	}
 }
 
+func TestTimeoutManualClock(t *testing.T) {
+	clock := newManualClock()
+	start := clock.now()
+	cfg := clock.config(Config{Timeout: time.Millisecond, Delay: 300 * time.Microsecond, Jitter: NoJitter})
+	var fnCalled int
+	err := Do(context.Background(), cfg, func(ctx context.Context) error {
+		fnCalled++
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		return ErrRetry{errors.New("do it again")}
+	})
+	if err != context.DeadlineExceeded {
+		t.Errorf("Do was supposed to return %v, returned %v", context.DeadlineExceeded, err)
+	}
+	if fnCalled != 4 {
+		t.Errorf("fn was supposed to be called %d times, called %d times", 4, fnCalled)
+	}
+	if elapsed := clock.now().Sub(start); elapsed != 1200*time.Microsecond {
+		t.Errorf("Do was supposed to take %v of fake time, took %v", 1200*time.Microsecond, elapsed)
+	}
+}
+
 func TestTimeoutPreDelay(t *testing.T) {
 	cfg := Config{Delay: 100 * time.Hour, Timeout: time.Microsecond, PreDelay: 100 * time.Hour}
 	var fnCalled bool
@@ -281,3 +419,3804 @@ func TestTimeoutDelay(t *testing.T) {
 		t.Fatalf("Do was supposed to return 'dealine exceeded', returned %v", err)
 	}
 }
+
+func TestDoFirstTry(t *testing.T) {
+	cfg := Config{Delay: time.Nanosecond}
+
+	firstTry, err := DoFirstTry(context.Background(), cfg, func(ctx context.Context) error {
+		return nil
+	})
+	if err != nil || !firstTry {
+		t.Fatalf("DoFirstTry was supposed to return (true, nil), returned (%v, %v)", firstTry, err)
+	}
+
+	var fnCalled int
+	firstTry, err = DoFirstTry(context.Background(), cfg, func(ctx context.Context) error {
+		fnCalled++
+		if fnCalled == 3 {
+			return nil
+		}
+		return ErrRetry{errors.New("do it again")}
+	})
+	if err != nil || firstTry {
+		t.Fatalf("DoFirstTry was supposed to return (false, nil), returned (%v, %v)", firstTry, err)
+	}
+
+	errFail := errors.New("fail")
+	firstTry, err = DoFirstTry(context.Background(), cfg, func(ctx context.Context) error {
+		return errFail
+	})
+	if !errors.Is(err, errFail) || firstTry {
+		t.Fatalf("DoFirstTry was supposed to return (false, fail), returned (%v, %v)", firstTry, err)
+	}
+}
+
+func TestApplyJitter(t *testing.T) {
+	base := time.Second
+	for _, tc := range []struct {
+		jitter float64
+		rnd    float64
+		want   time.Duration
+	}{
+		{0, 0, base},
+		{0, 0.5, base},
+		{0, 0.999, base},
+		{NoJitter, 0, base},
+		{NoJitter, 0.999, base},
+		{1, 0, 0},
+		{1, 0.5, base},
+		{1, 0.75, 1500 * time.Millisecond},
+		{0.5, 0, 500 * time.Millisecond},
+		{0.5, 0.25, 750 * time.Millisecond},
+		{0.5, 0.5, base},
+	} {
+		if got := applyJitter(base, tc.jitter, tc.rnd); got != tc.want {
+			t.Errorf("applyJitter(%v, %v, %v) = %v, want %v", base, tc.jitter, tc.rnd, got, tc.want)
+		}
+	}
+
+	// Jitter is symmetric around base
+	for _, jitter := range []float64{0.125, 0.5, 1} {
+		for _, rnd := range []float64{0, 0.125, 0.375} {
+			below := base - applyJitter(base, jitter, rnd)
+			above := applyJitter(base, jitter, 1-rnd) - base
+			if below != above {
+				t.Errorf("applyJitter is asymmetric for jitter %v, rnd %v: -%v/+%v", jitter, rnd, below, above)
+			}
+		}
+	}
+
+	// Upper bound is exclusive, as rnd is within [0,1)
+	if got := applyJitter(base, 1, 0.999999); got >= 2*base {
+		t.Errorf("applyJitter exceeded upper bound: %v", got)
+	}
+}
+
+// TestJitterUniform checks with Kolmogorov-Smirnov test that jittered delays
+// are uniformly distributed across the whole jitter band
+func TestJitterUniform(t *testing.T) {
+	const n = 10000
+	// Critical value for significance level 0.001. The source is seeded, so
+	// the test is deterministic.
+	const critical = 1.95 / 100 // 1.95/sqrt(n)
+
+	base := time.Second
+	for _, jitter := range []float64{0.125, 0.5, 1} {
+		rnd := rand.New(rand.NewSource(1))
+		samples := make([]float64, n)
+		for i := range samples {
+			samples[i] = float64(applyJitter(base, jitter, rnd.Float64()))
+		}
+		slices.Sort(samples)
+
+		low, width := float64(base)*(1-jitter), float64(base)*2*jitter
+		var d float64
+		for i, x := range samples {
+			cdf := (x - low) / width
+			d = max(d, cdf-float64(i)/n, float64(i+1)/n-cdf)
+		}
+		if d > critical {
+			t.Errorf("Jittered delays for jitter %v are not uniform: KS statistic %v exceeds %v", jitter, d, critical)
+		}
+	}
+}
+
+func TestRandObserver(t *testing.T) {
+	var delays []time.Duration
+	timeAfter := func(t time.Duration) <-chan time.Time {
+		delays = append(delays, t)
+		return time.After(0)
+	}
+
+	var observed []float64
+	cfg := Config{
+		Delay:        time.Second,
+		Jitter:       0.5,
+		RandObserver: func(rnd float64) { observed = append(observed, rnd) },
+		timeAfter:    timeAfter,
+	}
+
+	var fnCalled int
+	err := Do(context.Background(), cfg, func(ctx context.Context) error {
+		fnCalled++
+		if fnCalled == 5 {
+			return nil
+		}
+		return ErrRetry{errors.New("do it again")}
+	})
+	if err != nil {
+		t.Fatalf("Do was supposed to return successfully, returned %v", err)
+	}
+
+	if len(observed) != len(delays) {
+		t.Fatalf("Observer was supposed to be called %d times, called %d times", len(delays), len(observed))
+	}
+	for i, rnd := range observed {
+		if expected := applyJitter(time.Second, 0.5, rnd); delays[i] != expected {
+			t.Errorf("Delay %d was supposed to be %v for observed %v, got %v", i, expected, rnd, delays[i])
+		}
+	}
+}
+
+func TestBackoffSchedule(t *testing.T) {
+	var delays []time.Duration
+	timeAfter := func(t time.Duration) <-chan time.Time {
+		delays = append(delays, t)
+		return time.After(0)
+	}
+
+	cfg := Config{
+		BackoffSchedule: []BackoffPhase{
+			{Delay: 100 * time.Millisecond, Attempts: 3},
+			{Delay: time.Second, Scale: 2},
+		},
+		MaxDelay:  5 * time.Second,
+		Jitter:    NoJitter,
+		timeAfter: timeAfter,
+	}
+
+	var fnCalled int
+	err := Do(context.Background(), cfg, func(ctx context.Context) error {
+		fnCalled++
+		if fnCalled == 7 {
+			return ErrRestart{errors.New("restart")}
+		}
+		if fnCalled == 9 {
+			return nil
+		}
+		return ErrRetry{errors.New("do it again")}
+	})
+	if err != nil {
+		t.Fatalf("Do was supposed to return successfully, returned %v", err)
+	}
+
+	expectedDelays := []time.Duration{
+		100 * time.Millisecond, // constant phase
+		100 * time.Millisecond,
+		100 * time.Millisecond,
+		1 * time.Second, // exponential phase
+		2 * time.Second,
+		4 * time.Second,
+		100 * time.Millisecond, // schedule has been reset by ErrRestart
+		100 * time.Millisecond,
+	}
+	if slices.Compare(delays, expectedDelays) != 0 {
+		t.Errorf("Delays were supposed to be %v, got %v", expectedDelays, delays)
+	}
+}
+
+func TestBackoffScheduleMaxDelay(t *testing.T) {
+	var delays []time.Duration
+	cfg := Config{
+		BackoffSchedule: []BackoffPhase{
+			{Delay: 100 * time.Millisecond, Attempts: 1},
+			{Delay: 10 * time.Second},
+		},
+		MaxDelay: time.Second,
+		Jitter:   NoJitter,
+		timeAfter: func(d time.Duration) <-chan time.Time {
+			delays = append(delays, d)
+			return time.After(0)
+		},
+	}
+
+	var fnCalled int
+	err := Do(context.Background(), cfg, func(ctx context.Context) error {
+		fnCalled++
+		if fnCalled == 4 {
+			return nil
+		}
+		return ErrRetry{errors.New("do it again")}
+	})
+	if err != nil {
+		t.Fatalf("Do was supposed to return successfully, returned %v", err)
+	}
+
+	expectedDelays := []time.Duration{100 * time.Millisecond, time.Second, time.Second}
+	if !slices.Equal(delays, expectedDelays) {
+		t.Errorf("Delays were supposed to be %v, got %v", expectedDelays, delays)
+	}
+}
+
+func TestDelayAboveMaxDelay(t *testing.T) {
+	var delays []time.Duration
+	cfg := Config{
+		Delay:    10 * time.Second,
+		MaxDelay: time.Second,
+		Jitter:   NoJitter,
+		timeAfter: func(d time.Duration) <-chan time.Time {
+			delays = append(delays, d)
+			return time.After(0)
+		},
+	}
+
+	var fnCalled int
+	err := Do(context.Background(), cfg, func(ctx context.Context) error {
+		fnCalled++
+		if fnCalled == 3 {
+			return nil
+		}
+		return ErrRetry{errors.New("do it again")}
+	})
+	if err != nil {
+		t.Fatalf("Do was supposed to return successfully, returned %v", err)
+	}
+
+	// Only the scaled delays are capped by MaxDelay
+	expectedDelays := []time.Duration{10 * time.Second, time.Second}
+	if !slices.Equal(delays, expectedDelays) {
+		t.Errorf("Delays were supposed to be %v, got %v", expectedDelays, delays)
+	}
+}
+
+func TestBackoffScheduleDuration(t *testing.T) {
+	var now time.Time
+	var delays []time.Duration
+	timeAfter := func(d time.Duration) <-chan time.Time {
+		delays = append(delays, d)
+		now = now.Add(d)
+		return time.After(0)
+	}
+
+	cfg := Config{
+		BackoffSchedule: []BackoffPhase{
+			{Delay: 100 * time.Millisecond, Duration: 250 * time.Millisecond},
+			{Delay: time.Second},
+		},
+		Jitter:    NoJitter,
+		timeAfter: timeAfter,
+		now:       func() time.Time { return now },
+	}
+
+	var fnCalled int
+	err := Do(context.Background(), cfg, func(ctx context.Context) error {
+		fnCalled++
+		if fnCalled == 6 {
+			return nil
+		}
+		return ErrRetry{errors.New("do it again")}
+	})
+	if err != nil {
+		t.Fatalf("Do was supposed to return successfully, returned %v", err)
+	}
+
+	expectedDelays := []time.Duration{
+		100 * time.Millisecond,
+		100 * time.Millisecond,
+		100 * time.Millisecond, // 200ms elapsed, still within the first phase
+		1 * time.Second,        // 300ms elapsed, second phase
+		1 * time.Second,
+	}
+	if slices.Compare(delays, expectedDelays) != 0 {
+		t.Errorf("Delays were supposed to be %v, got %v", expectedDelays, delays)
+	}
+}
+
+func TestRetryOnCtxError(t *testing.T) {
+	t.Run("disabled", func(t *testing.T) {
+		var fnCalled int
+		err := Do(context.Background(), Config{Delay: time.Nanosecond}, func(ctx context.Context) error {
+			fnCalled++
+			return fmt.Errorf("attempt: %w", context.DeadlineExceeded)
+		})
+		if fnCalled != 1 {
+			t.Fatalf("fn was supposed to be called once, called %d times", fnCalled)
+		}
+		if !errors.Is(err, context.DeadlineExceeded) {
+			t.Fatalf("Do was supposed to return 'deadline exceeded', returned %v", err)
+		}
+	})
+	t.Run("per-attempt deadline", func(t *testing.T) {
+		var fnCalled int
+		err := Do(context.Background(), Config{Delay: time.Nanosecond, RetryOnCtxError: true}, func(ctx context.Context) error {
+			fnCalled++
+			if fnCalled == 3 {
+				return nil
+			}
+			return fmt.Errorf("attempt: %w", context.DeadlineExceeded)
+		})
+		if err != nil {
+			t.Fatalf("Do was supposed to return successfully, returned %v", err)
+		}
+		if fnCalled != 3 {
+			t.Fatalf("fn was supposed to be called 3 times, called %d times", fnCalled)
+		}
+	})
+	t.Run("overall deadline", func(t *testing.T) {
+		var fnCalled int
+		cfg := Config{Delay: time.Nanosecond, Timeout: time.Microsecond, RetryOnCtxError: true}
+		err := Do(context.Background(), cfg, func(ctx context.Context) error {
+			fnCalled++
+			<-ctx.Done()
+			return ctx.Err()
+		})
+		if fnCalled != 1 {
+			t.Fatalf("fn was supposed to be called once, called %d times", fnCalled)
+		}
+		if !errors.Is(err, context.DeadlineExceeded) {
+			t.Fatalf("Do was supposed to return 'deadline exceeded', returned %v", err)
+		}
+	})
+}
+
+// recordingHandler collects log records for inspection by tests
+type recordingHandler struct {
+	mu      sync.Mutex
+	records []slog.Record
+}
+
+func (h *recordingHandler) Enabled(context.Context, slog.Level) bool { return true }
+func (h *recordingHandler) WithAttrs([]slog.Attr) slog.Handler       { return h }
+func (h *recordingHandler) WithGroup(string) slog.Handler            { return h }
+
+func (h *recordingHandler) Handle(_ context.Context, r slog.Record) error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.records = append(h.records, r)
+	return nil
+}
+
+// loggedErrors returns the "error" attribute of each collected record
+func (h *recordingHandler) loggedErrors() []string {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	var out []string
+	for _, r := range h.records {
+		r.Attrs(func(a slog.Attr) bool {
+			if a.Key == "error" {
+				out = append(out, a.Value.String())
+			}
+			return true
+		})
+	}
+	return out
+}
+
+func TestLogDedup(t *testing.T) {
+	h := &recordingHandler{}
+	cfg := Config{Delay: time.Nanosecond, Logger: slog.New(h)}
+
+	errs := []error{
+		ErrRetry{errors.New("a")},
+		ErrRetry{errors.New("a")},
+		ErrRetry{errors.New("b")},
+		ErrRetry{errors.New("b")},
+		ErrRestart{errors.New("b")},
+		ErrRetry{errors.New("b")}, // first error after restart
+		ErrRetry{errors.New("b")},
+		nil,
+	}
+	var fnCalled int
+	err := Do(context.Background(), cfg, func(ctx context.Context) error {
+		fnCalled++
+		return errs[fnCalled-1]
+	})
+	if err != nil {
+		t.Fatalf("Do was supposed to return successfully, returned %v", err)
+	}
+
+	expected := []string{"a", "b", "b"}
+	if logged := h.loggedErrors(); slices.Compare(logged, expected) != 0 {
+		t.Errorf("Logged errors were supposed to be %v, got %v", expected, logged)
+	}
+	for _, r := range h.records {
+		if r.Level != slog.LevelDebug {
+			t.Errorf("Log level was supposed to be %v, got %v", slog.LevelDebug, r.Level)
+		}
+	}
+}
+
+func TestDoBool(t *testing.T) {
+	cfg := Config{Delay: time.Nanosecond}
+
+	var fnCalled int
+	err := DoBool(context.Background(), cfg, func(ctx context.Context) (bool, error) {
+		fnCalled++
+		switch fnCalled {
+		case 1:
+			return true, errors.New("do it again")
+		case 2:
+			return true, nil
+		default:
+			return false, nil
+		}
+	})
+	if err != nil {
+		t.Fatalf("DoBool was supposed to return successfully, returned %v", err)
+	}
+	if fnCalled != 3 {
+		t.Fatalf("fn was supposed to be called 3 times, called %d times", fnCalled)
+	}
+
+	errFail := errors.New("fail")
+	err = DoBool(context.Background(), cfg, func(ctx context.Context) (bool, error) {
+		return false, errFail
+	})
+	if err != errFail {
+		t.Fatalf("DoBool was supposed to return %v, returned %v", errFail, err)
+	}
+}
+
+func TestMaxDelayFunc(t *testing.T) {
+	var now time.Time
+	var delays []time.Duration
+	timeAfter := func(d time.Duration) <-chan time.Time {
+		delays = append(delays, d)
+		now = now.Add(d)
+		return time.After(0)
+	}
+
+	type call struct {
+		attempt int
+		elapsed time.Duration
+	}
+	var calls []call
+	cfg := Config{
+		Delay:    time.Second,
+		Scale:    2,
+		MaxDelay: 2 * time.Second,
+		MaxDelayFunc: func(attempt int, elapsed time.Duration) time.Duration {
+			calls = append(calls, call{attempt, elapsed})
+			if attempt == 2 {
+				return 0 // falls back to MaxDelay
+			}
+			return elapsed / 2
+		},
+		Jitter:    NoJitter,
+		timeAfter: timeAfter,
+		now:       func() time.Time { return now },
+	}
+
+	var fnCalled int
+	err := Do(context.Background(), cfg, func(ctx context.Context) error {
+		fnCalled++
+		now = now.Add(10 * time.Second)
+		if fnCalled == 5 {
+			return nil
+		}
+		return ErrRetry{errors.New("do it again")}
+	})
+	if err != nil {
+		t.Fatalf("Do was supposed to return successfully, returned %v", err)
+	}
+
+	expectedCalls := []call{{1, 10 * time.Second}, {2, 21 * time.Second}, {3, 33 * time.Second}, {4, 45 * time.Second}}
+	if !slices.Equal(calls, expectedCalls) {
+		t.Errorf("MaxDelayFunc calls were supposed to be %v, got %v", expectedCalls, calls)
+	}
+
+	expectedDelays := []time.Duration{
+		1 * time.Second, // under the dynamic cap of 5s
+		2 * time.Second, // scaled, further scaling capped by MaxDelay
+		2 * time.Second, // scaling resumes under the dynamic cap of 16.5s
+		4 * time.Second,
+	}
+	if slices.Compare(delays, expectedDelays) != 0 {
+		t.Errorf("Delays were supposed to be %v, got %v", expectedDelays, delays)
+	}
+}
+
+func TestMaxDelayFuncNegative(t *testing.T) {
+	cfg := Config{
+		Delay:        time.Nanosecond,
+		MaxDelayFunc: func(int, time.Duration) time.Duration { return -1 },
+	}
+	err := Do(context.Background(), cfg, func(ctx context.Context) error {
+		return ErrRetry{errors.New("do it again")}
+	})
+	if err == nil {
+		t.Fatalf("Do was supposed to return an error")
+	}
+}
+
+func newDisabledLogger() (*retryLogger, error) {
+	logger := slog.New(slog.NewTextHandler(io.Discard, &slog.HandlerOptions{Level: slog.LevelInfo}))
+	return &retryLogger{logger: logger, level: slog.LevelDebug, firstLevel: slog.LevelDebug, dedupKey: errorString}, ErrRetry{fmt.Errorf("wrapped: %w", errors.New("do it again"))}
+}
+
+func BenchmarkLogDisabled(b *testing.B) {
+	l, err := newDisabledLogger()
+	ctx := context.Background()
+
+	b.ReportAllocs()
+	for range b.N {
+		l.log(ctx, "retrying", err)
+	}
+}
+
+func TestLogDisabledAllocs(t *testing.T) {
+	l, err := newDisabledLogger()
+	ctx := context.Background()
+
+	allocs := testing.AllocsPerRun(100, func() {
+		l.log(ctx, "retrying", err)
+	})
+	if allocs != 0 {
+		t.Errorf("Logging at disabled level was supposed to allocate nothing, allocated %v times", allocs)
+	}
+}
+
+func TestPreDelayCtx(t *testing.T) {
+	t.Run("cancelled during pre-delay", func(t *testing.T) {
+		preDelayCtx, preDelayDone := context.WithCancel(context.Background())
+		defer preDelayDone()
+
+		cfg := Config{
+			PreDelay:    100 * time.Hour,
+			PreDelayCtx: preDelayCtx,
+			Delay:       time.Nanosecond,
+			timeAfter:   timeAfterCancelOn100Hours(preDelayDone),
+		}
+		var fnCalled bool
+		err := Do(context.Background(), cfg, func(ctx context.Context) error {
+			fnCalled = true
+			if ctx.Err() != nil {
+				t.Errorf("Context passed to fn was not supposed to be cancelled")
+			}
+			return nil
+		})
+		if err != nil {
+			t.Fatalf("Do was supposed to return successfully, returned %v", err)
+		}
+		if !fnCalled {
+			t.Fatalf("fn was supposed to be called after the pre-delay was cut short")
+		}
+	})
+	t.Run("already cancelled", func(t *testing.T) {
+		preDelayCtx, preDelayDone := context.WithCancel(context.Background())
+		preDelayDone()
+
+		cfg := Config{PreDelay: 100 * time.Hour, PreDelayCtx: preDelayCtx, Delay: time.Nanosecond}
+		var fnCalled bool
+		err := Do(context.Background(), cfg, func(ctx context.Context) error {
+			fnCalled = true
+			return nil
+		})
+		if err != nil {
+			t.Fatalf("Do was supposed to return successfully, returned %v", err)
+		}
+		if !fnCalled {
+			t.Fatalf("fn was supposed to be called with the pre-delay skipped")
+		}
+	})
+}
+
+func TestLogName(t *testing.T) {
+	for _, name := range []string{"", "fetch"} {
+		t.Run(name, func(t *testing.T) {
+			h := &recordingHandler{}
+			cfg := Config{Delay: time.Nanosecond, Name: name, Logger: slog.New(h)}
+
+			var fnCalled int
+			err := Do(context.Background(), cfg, func(ctx context.Context) error {
+				fnCalled++
+				switch fnCalled {
+				case 1:
+					return ErrRetry{errors.New("a")}
+				case 2:
+					return ErrRestart{errors.New("b")}
+				default:
+					return nil
+				}
+			})
+			if err != nil {
+				t.Fatalf("Do was supposed to return successfully, returned %v", err)
+			}
+
+			if len(h.records) != 2 {
+				t.Fatalf("Two records were supposed to be logged, got %d", len(h.records))
+			}
+			for _, r := range h.records {
+				var op string
+				var found bool
+				r.Attrs(func(a slog.Attr) bool {
+					if a.Key == "op" {
+						op, found = a.Value.String(), true
+					}
+					return true
+				})
+				if found != (name != "") || op != name {
+					t.Errorf("Record %q was supposed to have op %q, got %q (present: %v)", r.Message, name, op, found)
+				}
+			}
+		})
+	}
+}
+
+func TestOnExhausted(t *testing.T) {
+	errDoItAgain := errors.New("do it again")
+	errExhausted := errors.New("exhausted")
+
+	t.Run("timeout", func(t *testing.T) {
+		var gotErr error
+		var gotAttempts int
+		cfg := Config{
+			Delay:   100 * time.Hour,
+			Timeout: time.Microsecond,
+			OnExhausted: func(lastErr error, attempts int) error {
+				gotErr, gotAttempts = lastErr, attempts
+				return errExhausted
+			},
+		}
+		err := Do(context.Background(), cfg, func(ctx context.Context) error {
+			return ErrRetry{errDoItAgain}
+		})
+		if err != errExhausted {
+			t.Fatalf("Do was supposed to return %v, returned %v", errExhausted, err)
+		}
+		if !errors.Is(gotErr, errDoItAgain) || gotAttempts != 1 {
+			t.Fatalf("OnExhausted was supposed to be called with (%v, 1), called with (%v, %d)", errDoItAgain, gotErr, gotAttempts)
+		}
+	})
+	for _, cfg := range []Config{
+		{Delay: time.Nanosecond, NoRetry: true},
+		{Delay: time.Nanosecond, MaxTotalAttempts: 3},
+	} {
+		t.Run(fmt.Sprintf("attempts %v %v", cfg.NoRetry, cfg.MaxTotalAttempts), func(t *testing.T) {
+			var gotErr error
+			var gotAttempts int
+			cfg.OnExhausted = func(lastErr error, attempts int) error {
+				gotErr, gotAttempts = lastErr, attempts
+				return errExhausted
+			}
+			err := Do(context.Background(), cfg, func(ctx context.Context) error {
+				return ErrRestart{errDoItAgain}
+			})
+			if err != errExhausted {
+				t.Fatalf("Do was supposed to return %v, returned %v", errExhausted, err)
+			}
+			attempts := max(1, cfg.MaxTotalAttempts)
+			if gotErr != errDoItAgain || gotAttempts != attempts {
+				t.Fatalf("OnExhausted was supposed to be called with (%v, %d), called with (%v, %d)", errDoItAgain, attempts, gotErr, gotAttempts)
+			}
+		})
+	}
+	t.Run("nil makes Do succeed", func(t *testing.T) {
+		cfg := Config{
+			Delay:       100 * time.Hour,
+			Timeout:     time.Microsecond,
+			OnExhausted: func(error, int) error { return nil },
+		}
+		err := Do(context.Background(), cfg, func(ctx context.Context) error {
+			return ErrRetry{errDoItAgain}
+		})
+		if err != nil {
+			t.Fatalf("Do was supposed to return successfully, returned %v", err)
+		}
+	})
+	t.Run("not called on cancel", func(t *testing.T) {
+		ctx, done := context.WithCancel(context.Background())
+		defer done()
+
+		var called bool
+		cfg := Config{
+			Delay:       100 * time.Hour,
+			Timeout:     100 * time.Hour,
+			OnExhausted: func(error, int) error { called = true; return nil },
+		}
+		err := Do(ctx, cfg, func(ctx context.Context) error {
+			done()
+			return ErrRetry{errDoItAgain}
+		})
+		if called {
+			t.Fatalf("OnExhausted was not supposed to be called on cancellation")
+		}
+		if !errors.Is(err, context.Canceled) {
+			t.Fatalf("Do was supposed to return 'canceled' error, returned %v", err)
+		}
+	})
+}
+
+func TestMaxDelayJitter(t *testing.T) {
+	var delays []time.Duration
+	timeAfter := func(t time.Duration) <-chan time.Time {
+		delays = append(delays, t)
+		return time.After(0)
+	}
+
+	cfg := Config{
+		Delay:          time.Second,
+		Scale:          2,
+		MaxDelay:       4 * time.Second,
+		MaxDelayJitter: 500 * time.Millisecond,
+		Jitter:         NoJitter,
+		timeAfter:      timeAfter,
+	}
+
+	var fnCalled int
+	err := Do(context.Background(), cfg, func(ctx context.Context) error {
+		fnCalled++
+		if fnCalled == 1000 {
+			return nil
+		}
+		return ErrRetry{errors.New("do it again")}
+	})
+	if err != nil {
+		t.Fatalf("Do was supposed to return successfully, returned %v", err)
+	}
+
+	if expected := []time.Duration{time.Second, 2 * time.Second}; slices.Compare(delays[:2], expected) != 0 {
+		t.Errorf("Delays before saturation were supposed to be exact %v, got %v", expected, delays[:2])
+	}
+
+	var under36, over44 int
+	for _, delay := range delays[2:] {
+		if delay < 3500*time.Millisecond || delay > 4500*time.Millisecond {
+			t.Errorf("Saturated delays were supposed to be 4s+-0.5s, got %v", delay)
+		}
+		if delay < 3600*time.Millisecond {
+			under36++
+		}
+		if delay > 4400*time.Millisecond {
+			over44++
+		}
+	}
+	if under36 == 0 || over44 == 0 {
+		t.Errorf("Saturated delays were supposed to spread over 4s+-0.5s, got %d delays under 3.6s and %d over 4.4s", under36, over44)
+	}
+}
+
+func TestStopOn(t *testing.T) {
+	errFatal := errors.New("fatal")
+	cfg := Config{Delay: time.Nanosecond, StopOn: []error{errFatal, context.Canceled}}
+
+	for _, tc := range []struct {
+		name string
+		err  error
+		want error
+	}{
+		{"ErrRetry", ErrRetry{errFatal}, errFatal},
+		{"ErrRestart", ErrRestart{errFatal}, errFatal},
+		{"wrapped cause", ErrRetry{fmt.Errorf("reading: %w", context.Canceled)}, context.Canceled},
+		{"bare", errFatal, errFatal},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			var fnCalled int
+			err := Do(context.Background(), cfg, func(ctx context.Context) error {
+				fnCalled++
+				return tc.err
+			})
+			if fnCalled != 1 {
+				t.Fatalf("fn was supposed to be called once, called %d times", fnCalled)
+			}
+			if !errors.Is(err, tc.want) {
+				t.Fatalf("Do was supposed to return %v, returned %v", tc.want, err)
+			}
+			var errRetry ErrRetry
+			var errRestart ErrRestart
+			if errors.As(err, &errRetry) || errors.As(err, &errRestart) {
+				t.Fatalf("Do was supposed to return the cause without retry wrapper, returned %#v", err)
+			}
+		})
+	}
+
+	t.Run("no match", func(t *testing.T) {
+		var fnCalled int
+		err := Do(context.Background(), cfg, func(ctx context.Context) error {
+			fnCalled++
+			if fnCalled == 3 {
+				return nil
+			}
+			return ErrRetry{errors.New("do it again")}
+		})
+		if err != nil || fnCalled != 3 {
+			t.Fatalf("Do was supposed to retry until success, returned %v after %d calls", err, fnCalled)
+		}
+	})
+}
+
+func TestMaxJitterAbsolute(t *testing.T) {
+	var delays []time.Duration
+	timeAfter := func(t time.Duration) <-chan time.Time {
+		delays = append(delays, t)
+		return time.After(0)
+	}
+
+	cfg := Config{
+		Delay:             2 * time.Hour,
+		Jitter:            0.5,
+		MaxJitterAbsolute: time.Minute,
+		timeAfter:         timeAfter,
+	}
+
+	var fnCalled int
+	err := Do(context.Background(), cfg, func(ctx context.Context) error {
+		fnCalled++
+		if fnCalled == 1000 {
+			return nil
+		}
+		return ErrRetry{errors.New("do it again")}
+	})
+	if err != nil {
+		t.Fatalf("Do was supposed to return successfully, returned %v", err)
+	}
+
+	var clampedLow, clampedHigh int
+	for _, delay := range delays {
+		if delay < 2*time.Hour-time.Minute || delay > 2*time.Hour+time.Minute {
+			t.Errorf("Delays were supposed to be 2h+-1m, got %v", delay)
+		}
+		switch delay {
+		case 2*time.Hour - time.Minute:
+			clampedLow++
+		case 2*time.Hour + time.Minute:
+			clampedHigh++
+		}
+	}
+	if clampedLow == 0 || clampedHigh == 0 {
+		t.Errorf("Jitter was supposed to be clamped on both sides, got %d low and %d high", clampedLow, clampedHigh)
+	}
+}
+
+func TestNoRetry(t *testing.T) {
+	errCause := errors.New("cause")
+	for _, retErr := range []error{
+		ErrRetry{errCause},
+		ErrRestart{errCause},
+		errCause,
+		fmt.Errorf("wrapped: %w", ErrRetry{errCause}),
+		fmt.Errorf("wrapped: %w", ErrRestart{errCause}),
+		RetriableLoud(errCause),
+	} {
+		t.Run(fmt.Sprintf("%T %v", retErr, retErr), func(t *testing.T) {
+			var slept bool
+			timeAfter := func(d time.Duration) <-chan time.Time {
+				slept = true
+				return time.After(0)
+			}
+
+			var fnCalled int
+			err := Do(context.Background(), Config{Delay: time.Second, NoRetry: true, timeAfter: timeAfter}, func(ctx context.Context) error {
+				fnCalled++
+				return retErr
+			})
+			if fnCalled != 1 {
+				t.Fatalf("fn was supposed to be called once, called %d times", fnCalled)
+			}
+			if slept {
+				t.Fatalf("Do was not supposed to sleep")
+			}
+			if err != errCause {
+				t.Fatalf("Do was supposed to return %v, returned %#v", errCause, err)
+			}
+		})
+	}
+}
+
+func TestDoBatch(t *testing.T) {
+	errFatal := errors.New("fatal")
+
+	t.Run("retries failed items", func(t *testing.T) {
+		var delays []time.Duration
+		timeAfter := func(t time.Duration) <-chan time.Time {
+			delays = append(delays, t)
+			return time.After(0)
+		}
+
+		calls := map[int]int{}
+		cfg := Config{Delay: time.Second, Jitter: NoJitter, timeAfter: timeAfter}
+		failed, err := DoBatch(context.Background(), cfg, []int{1, 2, 3, 4}, func(ctx context.Context, item int) error {
+			calls[item]++
+			if item == 3 {
+				return errFatal
+			}
+			if calls[item] < item {
+				return ErrRetry{fmt.Errorf("item %d", item)}
+			}
+			return nil
+		})
+		if !errors.Is(err, errFatal) {
+			t.Fatalf("DoBatch was supposed to return %v, returned %v", errFatal, err)
+		}
+		if !slices.Equal(failed, []int{3}) {
+			t.Fatalf("DoBatch was supposed to return failed items [3], returned %v", failed)
+		}
+		expectedCalls := map[int]int{1: 1, 2: 2, 3: 1, 4: 4}
+		for item, n := range expectedCalls {
+			if calls[item] != n {
+				t.Errorf("Item %d was supposed to be tried %d times, tried %d times", item, n, calls[item])
+			}
+		}
+		// Backoff applies between rounds, not per item
+		if len(delays) != 3 {
+			t.Errorf("DoBatch was supposed to sleep 3 times, slept %d times", len(delays))
+		}
+	})
+
+	t.Run("classifies errors as Do", func(t *testing.T) {
+		errTransient := errors.New("transient")
+		errStopped := errors.New("stopped")
+		calls := map[string]int{}
+		cfg := Config{Delay: time.Nanosecond, RetryOn: []error{errTransient}, StopOn: []error{errStopped}}
+		failed, err := DoBatch(context.Background(), cfg, []string{"retry on", "stop on", "stop"}, func(ctx context.Context, item string) error {
+			calls[item]++
+			switch item {
+			case "retry on":
+				if calls[item] < 2 {
+					return errTransient
+				}
+				return nil
+			case "stop on":
+				return ErrRetry{errStopped}
+			default:
+				return ErrRetry{ErrStop}
+			}
+		})
+		if !errors.Is(err, errStopped) || errors.As(err, &ErrRetry{}) {
+			t.Fatalf("DoBatch was supposed to return %v, returned %v", errStopped, err)
+		}
+		if !slices.Equal(failed, []string{"stop on"}) {
+			t.Fatalf("DoBatch was supposed to return failed items [stop on], returned %v", failed)
+		}
+		expectedCalls := map[string]int{"retry on": 2, "stop on": 1, "stop": 1}
+		for item, n := range expectedCalls {
+			if calls[item] != n {
+				t.Errorf("Item %q was supposed to be tried %d times, tried %d times", item, n, calls[item])
+			}
+		}
+	})
+
+	t.Run("returns pending items", func(t *testing.T) {
+		ctx, done := context.WithCancel(context.Background())
+		defer done()
+
+		var rounds int
+		failed, err := DoBatch(ctx, Config{Delay: time.Nanosecond}, []string{"a", "b", "c"}, func(ctx context.Context, item string) error {
+			if item == "a" {
+				rounds++
+				if rounds == 3 {
+					done()
+				}
+			}
+			if item == "b" {
+				return nil
+			}
+			return ErrRetry{errors.New("do it again")}
+		})
+		if !errors.Is(err, context.Canceled) {
+			t.Fatalf("DoBatch was supposed to return 'canceled' error, returned %v", err)
+		}
+		if !slices.Equal(failed, []string{"a", "c"}) {
+			t.Fatalf("DoBatch was supposed to return pending items [a c], returned %v", failed)
+		}
+	})
+
+	t.Run("all succeed", func(t *testing.T) {
+		failed, err := DoBatch(context.Background(), Config{Delay: time.Nanosecond}, []int{1, 2}, func(ctx context.Context, item int) error {
+			return nil
+		})
+		if err != nil || failed != nil {
+			t.Fatalf("DoBatch was supposed to return (nil, nil), returned (%v, %v)", failed, err)
+		}
+	})
+}
+
+func TestLogRootCause(t *testing.T) {
+	h := &recordingHandler{}
+	cfg := Config{Delay: time.Nanosecond, Logger: slog.New(h)}
+
+	errs := []error{
+		ErrRetry{fmt.Errorf("request: %w", fmt.Errorf("dial: %w", errors.New("connection refused")))},
+		ErrRetry{errors.New("plain")},
+		nil,
+	}
+	var fnCalled int
+	err := Do(context.Background(), cfg, func(ctx context.Context) error {
+		fnCalled++
+		return errs[fnCalled-1]
+	})
+	if err != nil {
+		t.Fatalf("Do was supposed to return successfully, returned %v", err)
+	}
+
+	var rootCauses []string
+	for _, r := range h.records {
+		var rootCause string
+		r.Attrs(func(a slog.Attr) bool {
+			if a.Key == "root_cause" {
+				rootCause = a.Value.String()
+			}
+			return true
+		})
+		rootCauses = append(rootCauses, rootCause)
+	}
+	if expected := []string{"connection refused", ""}; !slices.Equal(rootCauses, expected) {
+		t.Errorf("Root causes were supposed to be %q, got %q", expected, rootCauses)
+	}
+}
+
+func TestEffectiveTimeout(t *testing.T) {
+	now := time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	ctx, done := context.WithDeadline(context.Background(), now.Add(time.Minute))
+	defer done()
+	expiredCtx, expiredDone := context.WithDeadline(context.Background(), now.Add(-time.Minute))
+	defer expiredDone()
+
+	for _, tc := range []struct {
+		name    string
+		ctx     context.Context
+		timeout time.Duration
+		want    time.Duration
+	}{
+		{"no deadline", context.Background(), 0, 0},
+		{"no deadline, explicit", context.Background(), time.Second, time.Second},
+		{"deadline", ctx, 0, time.Minute},
+		{"deadline, explicit", ctx, time.Second, time.Second},
+		{"expired deadline", expiredCtx, 0, 0},
+	} {
+		if got := effectiveTimeout(tc.ctx, tc.timeout, now); got != tc.want {
+			t.Errorf("%s: effective timeout was supposed to be %v, got %v", tc.name, tc.want, got)
+		}
+	}
+}
+
+func TestEffectiveTimeoutDo(t *testing.T) {
+	now := time.Now()
+	deadlineCtx, done := context.WithDeadline(context.Background(), now.Add(time.Minute))
+	defer done()
+
+	for _, tc := range []struct {
+		name     string
+		ctx      context.Context
+		timeout  time.Duration
+		deadline time.Time // zero if fn is supposed to receive no deadline
+		wrapped  bool      // whether fn is supposed to receive a context wrapping ctx
+	}{
+		{"no deadline", context.Background(), 0, time.Time{}, false},
+		{"no deadline, explicit", context.Background(), time.Second, now.Add(time.Second), true},
+		{"deadline", deadlineCtx, 0, now.Add(time.Minute), false},
+		{"deadline, shorter explicit", deadlineCtx, time.Second, now.Add(time.Second), true},
+		{"deadline, longer explicit", deadlineCtx, time.Hour, now.Add(time.Minute), false},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			cfg := Config{Delay: time.Nanosecond, Timeout: tc.timeout, now: func() time.Time { return now }}
+			err := Do(tc.ctx, cfg, func(ctx context.Context) error {
+				deadline, _ := ctx.Deadline()
+				if !deadline.Equal(tc.deadline) {
+					t.Errorf("fn was supposed to receive deadline %v, got %v", tc.deadline, deadline)
+				}
+				if wrapped := ctx != tc.ctx; wrapped != tc.wrapped {
+					t.Errorf("fn was supposed to receive wrapped context: %v, got %v", tc.wrapped, wrapped)
+				}
+				return nil
+			})
+			if err != nil {
+				t.Fatalf("Do was supposed to return successfully, returned %v", err)
+			}
+		})
+	}
+}
+
+func TestTransientErrors(t *testing.T) {
+	errs := []error{
+		ErrRetry{errors.New("a")},
+		ErrRestart{errors.New("b")},
+		ErrRetry{errors.New("c")},
+		ErrRetry{errors.New("d")},
+		nil,
+	}
+	run := func(ch chan error) error {
+		var fnCalled int
+		return Do(context.Background(), Config{Delay: time.Nanosecond, TransientErrors: ch}, func(ctx context.Context) error {
+			fnCalled++
+			return errs[fnCalled-1]
+		})
+	}
+
+	t.Run("buffered", func(t *testing.T) {
+		ch := make(chan error, 10)
+		if err := run(ch); err != nil {
+			t.Fatalf("Do was supposed to return successfully, returned %v", err)
+		}
+		close(ch)
+		var got []error
+		for err := range ch {
+			got = append(got, err)
+		}
+		if !slices.Equal(got, errs[:4]) {
+			t.Fatalf("Transient errors were supposed to be %v, got %v", errs[:4], got)
+		}
+	})
+	t.Run("full", func(t *testing.T) {
+		ch := make(chan error, 1)
+		if err := run(ch); err != nil {
+			t.Fatalf("Do was supposed to return successfully, returned %v", err)
+		}
+		if got := <-ch; got != errs[0] {
+			t.Fatalf("First transient error was supposed to be %v, got %v", errs[0], got)
+		}
+	})
+}
+
+type categoryError struct {
+	category string
+	msg      string
+}
+
+func (e categoryError) Error() string { return e.msg }
+
+func TestLogDedupKey(t *testing.T) {
+	h := &recordingHandler{}
+	cfg := Config{
+		Delay:  time.Nanosecond,
+		Logger: slog.New(h),
+		LogDedupKey: func(err error) string {
+			var catErr categoryError
+			if errors.As(err, &catErr) {
+				return catErr.category
+			}
+			return err.Error()
+		},
+	}
+
+	errs := []error{
+		ErrRetry{categoryError{"network", "failed"}},
+		ErrRetry{categoryError{"network", "failed"}},
+		ErrRetry{categoryError{"auth", "failed"}},
+		ErrRetry{categoryError{"auth", "failed again"}},
+		nil,
+	}
+	var fnCalled int
+	err := Do(context.Background(), cfg, func(ctx context.Context) error {
+		fnCalled++
+		return errs[fnCalled-1]
+	})
+	if err != nil {
+		t.Fatalf("Do was supposed to return successfully, returned %v", err)
+	}
+
+	expected := []string{"failed", "failed"}
+	if logged := h.loggedErrors(); !slices.Equal(logged, expected) {
+		t.Errorf("Logged errors were supposed to be %v, got %v", expected, logged)
+	}
+}
+
+type stubLimiter struct {
+	waits int
+	err   error
+}
+
+func (l *stubLimiter) Wait(ctx context.Context) error {
+	l.waits++
+	return l.err
+}
+
+func TestLimiter(t *testing.T) {
+	t.Run("waits before each attempt", func(t *testing.T) {
+		limiter := &stubLimiter{}
+		var fnCalled int
+		err := Do(context.Background(), Config{Delay: time.Nanosecond, Limiter: limiter}, func(ctx context.Context) error {
+			fnCalled++
+			if limiter.waits != fnCalled {
+				t.Errorf("Limiter was supposed to be waited on %d times before attempt, waited %d times", fnCalled, limiter.waits)
+			}
+			if fnCalled == 3 {
+				return nil
+			}
+			return ErrRetry{errors.New("do it again")}
+		})
+		if err != nil {
+			t.Fatalf("Do was supposed to return successfully, returned %v", err)
+		}
+	})
+	t.Run("error", func(t *testing.T) {
+		limiter := &stubLimiter{err: context.Canceled}
+		var fnCalled bool
+		err := Do(context.Background(), Config{Delay: time.Nanosecond, Limiter: limiter}, func(ctx context.Context) error {
+			fnCalled = true
+			return nil
+		})
+		if fnCalled {
+			t.Fatalf("fn was not supposed to be called when limiter fails")
+		}
+		if !errors.Is(err, context.Canceled) {
+			t.Fatalf("Do was supposed to return 'canceled' error, returned %v", err)
+		}
+	})
+}
+
+func TestOnAttemptEnd(t *testing.T) {
+	var now time.Time
+
+	type call struct {
+		attempt int
+		dur     time.Duration
+		err     error
+	}
+	var calls []call
+	cfg := Config{
+		Delay: time.Nanosecond,
+		OnAttemptEnd: func(attempt int, dur time.Duration, err error) {
+			calls = append(calls, call{attempt, dur, err})
+		},
+		now: func() time.Time { return now },
+	}
+
+	errs := []error{ErrRetry{errors.New("a")}, ErrRestart{errors.New("b")}, nil}
+	var fnCalled int
+	err := Do(context.Background(), cfg, func(ctx context.Context) error {
+		fnCalled++
+		now = now.Add(time.Duration(fnCalled) * time.Second)
+		return errs[fnCalled-1]
+	})
+	if err != nil {
+		t.Fatalf("Do was supposed to return successfully, returned %v", err)
+	}
+
+	expected := []call{{1, time.Second, errs[0]}, {2, 2 * time.Second, errs[1]}, {3, 3 * time.Second, nil}}
+	if !slices.Equal(calls, expected) {
+		t.Errorf("OnAttemptEnd calls were supposed to be %v, got %v", expected, calls)
+	}
+}
+
+func TestGoldenDelays(t *testing.T) {
+	run := func() []time.Duration {
+		var delays []time.Duration
+		timeAfter := func(t time.Duration) <-chan time.Time {
+			delays = append(delays, t)
+			return time.After(0)
+		}
+
+		cfg := Config{
+			PreDelay:  100 * time.Millisecond,
+			Delay:     time.Second,
+			Scale:     2,
+			MaxDelay:  5 * time.Second,
+			Jitter:    0.25,
+			Timeout:   time.Hour,
+			Rand:      rand.New(rand.NewSource(42)),
+			timeAfter: timeAfter,
+		}
+
+		var fnCalled int
+		err := Do(context.Background(), cfg, func(ctx context.Context) error {
+			fnCalled++
+			switch fnCalled {
+			case 5:
+				return ErrRestart{errors.New("restart")}
+			case 7:
+				return nil
+			default:
+				return ErrRetry{errors.New("do it again")}
+			}
+		})
+		if err != nil {
+			t.Fatalf("Do was supposed to return successfully, returned %v", err)
+		}
+		return delays
+	}
+
+	golden := []time.Duration{
+		100 * time.Millisecond, // pre-delay is not jittered
+		936514180,
+		1566000496,
+		4208187703,
+		4272046757, // 5s capped by MaxDelay
+		771909229,  // 1s after ErrRestart
+		1883193299,
+	}
+	for range 2 {
+		if delays := run(); !slices.Equal(delays, golden) {
+			t.Errorf("Delays were supposed to be %v, got %v", golden, delays)
+		}
+	}
+}
+
+func TestRetryOn(t *testing.T) {
+	errTransient := errors.New("transient")
+	errFatal := errors.New("fatal")
+	cfg := Config{Delay: time.Nanosecond, RetryOn: []error{errTransient, errFatal}, StopOn: []error{errFatal}}
+
+	for _, tc := range []struct {
+		name      string
+		err       error
+		wantCalls int
+	}{
+		{"match", errTransient, 3},
+		{"wrapped match", fmt.Errorf("request: %w", errTransient), 3},
+		{"no match", errors.New("other"), 1},
+		{"StopOn wins", errFatal, 1},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			var fnCalled int
+			err := Do(context.Background(), cfg, func(ctx context.Context) error {
+				fnCalled++
+				if fnCalled == 3 {
+					return nil
+				}
+				return tc.err
+			})
+			if fnCalled != tc.wantCalls {
+				t.Fatalf("fn was supposed to be called %d times, called %d times", tc.wantCalls, fnCalled)
+			}
+			if tc.wantCalls == 1 && err != tc.err {
+				t.Fatalf("Do was supposed to return %v, returned %v", tc.err, err)
+			}
+		})
+	}
+}
+
+func TestFromBackoffParams(t *testing.T) {
+	for _, tc := range []struct {
+		initial     time.Duration
+		randFactor  float64
+		multiplier  float64
+		maxInterval time.Duration
+	}{
+		{500 * time.Millisecond, 0.5, 1.5, 60 * time.Second}, // backoff library defaults
+		{time.Second, 0, 2, 10 * time.Second},
+		{100 * time.Millisecond, 0.1, 1, time.Second},
+	} {
+		t.Run(fmt.Sprint(tc), func(t *testing.T) {
+			cfg := FromBackoffParams(tc.initial, tc.randFactor, tc.multiplier, tc.maxInterval, time.Hour)
+			if err := cfg.Validate(); err != nil {
+				t.Fatalf("Config was supposed to be valid, got %v", err)
+			}
+
+			// Reference schedule, as computed by the backoff library
+			refRand := rand.New(rand.NewSource(1))
+			var expected []time.Duration
+			interval := tc.initial
+			for range 20 {
+				delta := tc.randFactor * float64(interval)
+				minInterval := float64(interval) - delta
+				maxInterval := float64(interval) + delta
+				expected = append(expected, time.Duration(minInterval+refRand.Float64()*(maxInterval-minInterval)))
+				if float64(interval) >= float64(tc.maxInterval)/tc.multiplier {
+					interval = tc.maxInterval
+				} else {
+					interval = time.Duration(float64(interval) * tc.multiplier)
+				}
+			}
+
+			var delays []time.Duration
+			cfg.timeAfter = func(t time.Duration) <-chan time.Time {
+				delays = append(delays, t)
+				return time.After(0)
+			}
+			cfg.Rand = rand.New(rand.NewSource(1))
+			var fnCalled int
+			err := Do(context.Background(), cfg, func(ctx context.Context) error {
+				fnCalled++
+				if fnCalled > len(expected) {
+					return nil
+				}
+				return ErrRetry{errors.New("do it again")}
+			})
+			if err != nil {
+				t.Fatalf("Do was supposed to return successfully, returned %v", err)
+			}
+
+			for i := range expected {
+				if diff := delays[i] - expected[i]; diff < -1 || diff > 1 {
+					t.Errorf("Delay %d was supposed to be %v, got %v", i, expected[i], delays[i])
+				}
+			}
+		})
+	}
+}
+
+func TestFirstErrorLogLevel(t *testing.T) {
+	h := &recordingHandler{}
+	cfg := Config{Delay: time.Nanosecond, Logger: slog.New(h), FirstErrorLogLevel: slog.LevelWarn}
+
+	errs := []error{
+		ErrRetry{errors.New("a")},
+		ErrRetry{errors.New("b")},
+		ErrRestart{errors.New("c")},
+		ErrRetry{errors.New("d")}, // first error after restart
+		ErrRetry{errors.New("e")},
+		nil,
+	}
+	var fnCalled int
+	err := Do(context.Background(), cfg, func(ctx context.Context) error {
+		fnCalled++
+		return errs[fnCalled-1]
+	})
+	if err != nil {
+		t.Fatalf("Do was supposed to return successfully, returned %v", err)
+	}
+
+	var levels []slog.Level
+	for _, r := range h.records {
+		levels = append(levels, r.Level)
+	}
+	expected := []slog.Level{slog.LevelWarn, slog.LevelDebug, slog.LevelDebug, slog.LevelWarn, slog.LevelDebug}
+	if !slices.Equal(levels, expected) {
+		t.Errorf("Log levels were supposed to be %v, got %v", expected, levels)
+	}
+}
+
+func TestJoinDistinctErrors(t *testing.T) {
+	run := func(errs []string) error {
+		ctx, done := context.WithCancel(context.Background())
+		defer done()
+
+		timeAfter := func(time.Duration) <-chan time.Time {
+			if ctx.Err() != nil {
+				return nil // never fires, so Do notices the cancellation
+			}
+			return time.After(0)
+		}
+
+		var fnCalled int
+		return Do(ctx, Config{Delay: time.Nanosecond, JoinDistinctErrors: true, timeAfter: timeAfter}, func(ctx context.Context) error {
+			fnCalled++
+			if fnCalled == len(errs) {
+				done()
+			}
+			return ErrRetry{errors.New(errs[fnCalled-1])}
+		})
+	}
+	joined := func(err error) []string {
+		var out []string
+		for _, e := range err.(interface{ Unwrap() []error }).Unwrap() {
+			out = append(out, e.Error())
+		}
+		return out
+	}
+
+	t.Run("repeated", func(t *testing.T) {
+		err := run([]string{"a", "a", "a", "b", "b", "c"})
+		if !errors.Is(err, context.Canceled) {
+			t.Fatalf("Do was supposed to return 'canceled' error, returned %v", err)
+		}
+		if expected := []string{"a", "b", "c", "context canceled"}; !slices.Equal(joined(err), expected) {
+			t.Errorf("Joined errors were supposed to be %v, got %v", expected, joined(err))
+		}
+		// An enclosing Do must not retry the joined error
+		if errors.As(err, &ErrRetry{}) {
+			t.Errorf("Joined errors were not supposed to be wrapped in ErrRetry, got %#v", err)
+		}
+	})
+	t.Run("alternating", func(t *testing.T) {
+		err := run([]string{"b", "a", "b", "a", "b"})
+		if expected := []string{"b", "a", "context canceled"}; !slices.Equal(joined(err), expected) {
+			t.Errorf("Joined errors were supposed to be %v, got %v", expected, joined(err))
+		}
+	})
+	t.Run("bounded", func(t *testing.T) {
+		var errs []string
+		for i := range 2 * maxDistinctErrors {
+			errs = append(errs, fmt.Sprint(i))
+		}
+		err := run(errs)
+		if n := len(joined(err)); n != maxDistinctErrors+1 {
+			t.Errorf("Joined error was supposed to contain %d errors, got %d", maxDistinctErrors+1, n)
+		}
+	})
+	t.Run("timeout in fn", func(t *testing.T) {
+		clock := newManualClock()
+		cfg := clock.config(Config{Delay: time.Millisecond, Timeout: time.Second, JoinDistinctErrors: true})
+		errs := []string{"a", "b", "a"}
+		var fnCalled int
+		err := Do(context.Background(), cfg, func(ctx context.Context) error {
+			fnCalled++
+			if fnCalled <= len(errs) {
+				return ErrRetry{errors.New(errs[fnCalled-1])}
+			}
+			clock.sleep(time.Hour) // fn takes longer than Timeout
+			<-ctx.Done()
+			return ctx.Err()
+		})
+		if !errors.Is(err, context.DeadlineExceeded) {
+			t.Fatalf("Do was supposed to return %v, returned %v", context.DeadlineExceeded, err)
+		}
+		if expected := []string{"a", "b", "context deadline exceeded"}; !slices.Equal(joined(err), expected) {
+			t.Errorf("Joined errors were supposed to be %v, got %v", expected, joined(err))
+		}
+	})
+	t.Run("max total attempts", func(t *testing.T) {
+		errs := []string{"a", "b", "b"}
+		var fnCalled int
+		err := Do(context.Background(), Config{Delay: time.Nanosecond, MaxTotalAttempts: 3, JoinDistinctErrors: true}, func(ctx context.Context) error {
+			fnCalled++
+			return ErrRetry{errors.New(errs[fnCalled-1])}
+		})
+		if !errors.Is(err, ErrTotalAttemptsExhausted) {
+			t.Fatalf("Do was supposed to return %v, returned %v", ErrTotalAttemptsExhausted, err)
+		}
+		if expected := []string{"a", "b", "total attempts exhausted: b"}; !slices.Equal(joined(err), expected) {
+			t.Errorf("Joined errors were supposed to be %v, got %v", expected, joined(err))
+		}
+	})
+}
+
+func TestSlowAttemptThreshold(t *testing.T) {
+	var now time.Time
+	h := &recordingHandler{}
+	cfg := Config{
+		Delay:                time.Nanosecond,
+		SlowAttemptThreshold: 2 * time.Second,
+		Logger:               slog.New(h),
+		LogLevel:             slog.LevelError, // tell retry logs apart from warnings
+		now:                  func() time.Time { return now },
+	}
+
+	durations := []time.Duration{time.Second, 3 * time.Second, 2 * time.Second, 5 * time.Second}
+	var fnCalled int
+	err := Do(context.Background(), cfg, func(ctx context.Context) error {
+		fnCalled++
+		now = now.Add(durations[fnCalled-1])
+		if fnCalled == len(durations) {
+			return nil
+		}
+		return ErrRetry{errors.New("do it again")}
+	})
+	if err != nil {
+		t.Fatalf("Do was supposed to return successfully, returned %v", err)
+	}
+
+	var warned []time.Duration
+	for _, r := range h.records {
+		if r.Level != slog.LevelWarn {
+			continue
+		}
+		r.Attrs(func(a slog.Attr) bool {
+			if a.Key == "duration" {
+				warned = append(warned, a.Value.Duration())
+			}
+			return true
+		})
+	}
+	if expected := []time.Duration{3 * time.Second, 5 * time.Second}; !slices.Equal(warned, expected) {
+		t.Errorf("Slow attempts were supposed to be %v, got %v", expected, warned)
+	}
+}
+
+type attemptKey struct{}
+
+func TestAttemptContext(t *testing.T) {
+	var started, ended []int
+	attemptContext := func(ctx context.Context, attempt int) (context.Context, func()) {
+		started = append(started, attempt)
+		return context.WithValue(ctx, attemptKey{}, attempt), func() { ended = append(ended, attempt) }
+	}
+
+	t.Run("each attempt", func(t *testing.T) {
+		started, ended = nil, nil
+		var fnCalled int
+		err := Do(context.Background(), Config{Delay: time.Nanosecond, AttemptContext: attemptContext}, func(ctx context.Context) error {
+			fnCalled++
+			if got := ctx.Value(attemptKey{}); got != fnCalled {
+				t.Errorf("Attempt %d was supposed to receive derived context, got value %v", fnCalled, got)
+			}
+			if len(ended) != fnCalled-1 {
+				t.Errorf("Previous attempts were supposed to be ended before attempt %d, ended %v", fnCalled, ended)
+			}
+			if fnCalled == 3 {
+				return nil
+			}
+			return ErrRetry{errors.New("do it again")}
+		})
+		if err != nil {
+			t.Fatalf("Do was supposed to return successfully, returned %v", err)
+		}
+		if expected := []int{1, 2, 3}; !slices.Equal(started, expected) || !slices.Equal(ended, expected) {
+			t.Errorf("Attempts were supposed to be started and ended %v, got %v and %v", expected, started, ended)
+		}
+	})
+	t.Run("panic", func(t *testing.T) {
+		started, ended = nil, nil
+		func() {
+			defer func() {
+				if recover() == nil {
+					t.Errorf("Panic was supposed to propagate")
+				}
+			}()
+			_ = Do(context.Background(), Config{Delay: time.Nanosecond, AttemptContext: attemptContext}, func(ctx context.Context) error {
+				panic("boom")
+			})
+		}()
+		if !slices.Equal(ended, []int{1}) {
+			t.Errorf("Attempt was supposed to be ended after panic, got %v", ended)
+		}
+	})
+}
+
+func TestStopAtMaxDelay(t *testing.T) {
+	var delays []time.Duration
+	timeAfter := func(t time.Duration) <-chan time.Time {
+		delays = append(delays, t)
+		return time.After(0)
+	}
+
+	cfg := Config{
+		Delay:          time.Second,
+		Scale:          2,
+		MaxDelay:       4 * time.Second,
+		StopAtMaxDelay: true,
+		MaxDelayStreak: 2,
+		Jitter:         NoJitter,
+		timeAfter:      timeAfter,
+	}
+
+	errLast := errors.New("last")
+	var fnCalled int
+	err := Do(context.Background(), cfg, func(ctx context.Context) error {
+		fnCalled++
+		switch fnCalled {
+		case 4:
+			return ErrRestart{errors.New("restart")}
+		case 8:
+			return ErrRetry{errLast}
+		default:
+			return ErrRetry{errors.New("do it again")}
+		}
+	})
+	if !errors.Is(err, ErrMaxDelayReached) || !errors.Is(err, errLast) {
+		t.Fatalf("Do was supposed to return %v wrapped with %v, returned %v", errLast, ErrMaxDelayReached, err)
+	}
+
+	expectedDelays := []time.Duration{
+		1 * time.Second,
+		2 * time.Second,
+		4 * time.Second, // streak 1
+		1 * time.Second, // streak has been reset by ErrRestart
+		2 * time.Second,
+		4 * time.Second, // streak 1
+		4 * time.Second, // streak 2, give up on the next one
+	}
+	if !slices.Equal(delays, expectedDelays) {
+		t.Errorf("Delays were supposed to be %v, got %v", expectedDelays, delays)
+	}
+	if fnCalled != 8 {
+		t.Errorf("fn was supposed to be called 8 times, called %d times", fnCalled)
+	}
+}
+
+type asRetryError struct{}
+
+func TestStopAtMaxDelayDynamicCap(t *testing.T) {
+	cfg := Config{
+		Delay: time.Millisecond,
+		// The cap is lifted for the third attempt, breaking the streak
+		MaxDelayFunc: func(attempt int, elapsed time.Duration) time.Duration {
+			if attempt == 3 {
+				return time.Hour
+			}
+			return time.Nanosecond
+		},
+		StopAtMaxDelay: true,
+		MaxDelayStreak: 2,
+		Jitter:         NoJitter,
+		timeAfter:      func(time.Duration) <-chan time.Time { return time.After(0) },
+	}
+
+	var fnCalled int
+	err := Do(context.Background(), cfg, func(ctx context.Context) error {
+		fnCalled++
+		return ErrRetry{errors.New("do it again")}
+	})
+	if !errors.Is(err, ErrMaxDelayReached) {
+		t.Fatalf("Do was supposed to return %v, returned %v", ErrMaxDelayReached, err)
+	}
+	if fnCalled != 6 {
+		t.Errorf("fn was supposed to be called %d times, called %d times", 6, fnCalled)
+	}
+}
+
+func (asRetryError) Error() string { return "as retry" }
+func (asRetryError) As(target any) bool {
+	if errRetry, ok := target.(*ErrRetry); ok {
+		*errRetry = ErrRetry{errors.New("as retry")}
+		return true
+	}
+	return false
+}
+
+func TestClassify(t *testing.T) {
+	base := errors.New("base")
+	for _, err := range []error{
+		nil,
+		base,
+		ErrRetry{base},
+		ErrRestart{base},
+		fmt.Errorf("wrapped: %w", ErrRetry{base}),
+		fmt.Errorf("wrapped: %w", ErrRestart{base}),
+		ErrRetry{ErrRestart{base}},
+		errors.Join(base, ErrRetry{base}),
+		errors.Join(ErrRestart{base}, fmt.Errorf("wrapped: %w", ErrRetry{base})),
+		fmt.Errorf("both: %w, %w", base, ErrRestart{base}),
+		asRetryError{},
+		fmt.Errorf("wrapped: %w", asRetryError{}),
+	} {
+		var errRetry ErrRetry
+		var errRestart ErrRestart
+		wantRetry, wantRestart := errors.As(err, &errRetry), errors.As(err, &errRestart)
+		if gotRetry, gotRestart := classify(err); gotRetry != wantRetry || gotRestart != wantRestart {
+			t.Errorf("classify(%v) = (%v, %v), want (%v, %v)", err, gotRetry, gotRestart, wantRetry, wantRestart)
+		}
+	}
+}
+
+func deeplyWrapped() error {
+	err := error(ErrRetry{errors.New("base")})
+	for i := range 10 {
+		err = fmt.Errorf("layer %d: %w", i, err)
+	}
+	return err
+}
+
+func BenchmarkClassify(b *testing.B) {
+	err := deeplyWrapped()
+	b.ReportAllocs()
+	for range b.N {
+		classify(err)
+	}
+}
+
+func BenchmarkClassifyErrorsAs(b *testing.B) {
+	err := deeplyWrapped()
+	b.ReportAllocs()
+	for range b.N {
+		var errRetry ErrRetry
+		var errRestart ErrRestart
+		_ = errors.As(err, &errRetry)
+		_ = errors.As(err, &errRestart)
+	}
+}
+
+func TestNextDelay(t *testing.T) {
+	var delays []time.Duration
+	timeAfter := func(t time.Duration) <-chan time.Time {
+		delays = append(delays, t)
+		return time.After(0)
+	}
+
+	type call struct {
+		attempt   int
+		prevDelay time.Duration
+	}
+	var calls []call
+	table := []time.Duration{time.Second, 5 * time.Second, 3 * time.Second, time.Hour}
+	cfg := Config{
+		NextDelay: func(attempt int, prevDelay time.Duration, err error) time.Duration {
+			calls = append(calls, call{attempt, prevDelay})
+			return table[attempt-1]
+		},
+		MaxDelay:  time.Minute,
+		Jitter:    0.5, // bypassed
+		timeAfter: timeAfter,
+	}
+
+	var fnCalled int
+	err := Do(context.Background(), cfg, func(ctx context.Context) error {
+		fnCalled++
+		if fnCalled == 5 {
+			return nil
+		}
+		return ErrRetry{errors.New("do it again")}
+	})
+	if err != nil {
+		t.Fatalf("Do was supposed to return successfully, returned %v", err)
+	}
+
+	expectedDelays := []time.Duration{time.Second, 5 * time.Second, 3 * time.Second, time.Minute}
+	if !slices.Equal(delays, expectedDelays) {
+		t.Errorf("Delays were supposed to be %v, got %v", expectedDelays, delays)
+	}
+	expectedCalls := []call{{1, 0}, {2, time.Second}, {3, 5 * time.Second}, {4, 3 * time.Second}}
+	if !slices.Equal(calls, expectedCalls) {
+		t.Errorf("NextDelay calls were supposed to be %v, got %v", expectedCalls, calls)
+	}
+
+	delays = nil
+	cfg.NextDelayUncapped = true
+	fnCalled = 0
+	_ = Do(context.Background(), cfg, func(ctx context.Context) error {
+		fnCalled++
+		if fnCalled == 5 {
+			return nil
+		}
+		return ErrRetry{errors.New("do it again")}
+	})
+	if !slices.Equal(delays, table) {
+		t.Errorf("Uncapped delays were supposed to be %v, got %v", table, delays)
+	}
+}
+
+func TestOnGiveUp(t *testing.T) {
+	errFatal := errors.New("fatal")
+	errDoItAgain := errors.New("do it again")
+
+	type giveUp struct {
+		reason   GiveUpReason
+		lastErr  error
+		attempts int
+	}
+
+	cancelled, cancel := context.WithCancel(context.Background())
+	cancel()
+	cancelledInFn, cancelInFn := context.WithCancel(context.Background())
+	defer cancelInFn()
+
+	for _, tc := range []struct {
+		name string
+		ctx  context.Context
+		cfg  Config
+		fn   func(ctx context.Context) error
+		want []giveUp
+	}{
+		{
+			name: "success",
+			cfg:  Config{Delay: time.Nanosecond},
+			fn:   func(ctx context.Context) error { return nil },
+		},
+		{
+			name: "permanent error",
+			cfg:  Config{Delay: time.Nanosecond},
+			fn:   func(ctx context.Context) error { return errFatal },
+			want: []giveUp{{GiveUpPermanentError, errFatal, 1}},
+		},
+		{
+			name: "timeout",
+			cfg:  Config{Delay: 100 * time.Hour, Timeout: time.Microsecond},
+			fn:   func(ctx context.Context) error { return ErrRetry{errDoItAgain} },
+			want: []giveUp{{GiveUpTimeout, ErrRetry{errDoItAgain}, 1}},
+		},
+		{
+			name: "timeout in fn",
+			cfg:  Config{Delay: time.Nanosecond, Timeout: time.Microsecond},
+			fn: func(ctx context.Context) error {
+				<-ctx.Done()
+				return ctx.Err()
+			},
+			want: []giveUp{{GiveUpTimeout, context.DeadlineExceeded, 1}},
+		},
+		{
+			name: "context cancelled in fn",
+			ctx:  cancelledInFn,
+			cfg:  Config{Delay: time.Nanosecond},
+			fn: func(ctx context.Context) error {
+				cancelInFn()
+				return ctx.Err()
+			},
+			want: []giveUp{{GiveUpContextCancelled, context.Canceled, 1}},
+		},
+		{
+			name: "context cancelled",
+			ctx:  cancelled,
+			cfg:  Config{Delay: time.Nanosecond},
+			fn:   func(ctx context.Context) error { return nil },
+			want: []giveUp{{GiveUpContextCancelled, nil, 0}},
+		},
+		{
+			name: "max attempts",
+			cfg:  Config{Delay: time.Nanosecond, NoRetry: true},
+			fn:   func(ctx context.Context) error { return ErrRetry{errDoItAgain} },
+			want: []giveUp{{GiveUpMaxAttempts, ErrRetry{errDoItAgain}, 1}},
+		},
+		{
+			name: "max delay reached",
+			cfg:  Config{Delay: time.Nanosecond, MaxDelay: time.Nanosecond, StopAtMaxDelay: true},
+			fn:   func(ctx context.Context) error { return ErrRetry{errDoItAgain} },
+			want: []giveUp{{GiveUpMaxDelayReached, ErrRetry{errDoItAgain}, 1}},
+		},
+		{
+			name: "negative next delay",
+			cfg:  Config{NextDelay: func(int, time.Duration, error) time.Duration { return -1 }},
+			fn:   func(ctx context.Context) error { return ErrRetry{errDoItAgain} },
+			want: []giveUp{{GiveUpInvalidDelay, ErrRetry{errDoItAgain}, 1}},
+		},
+		{
+			name: "negative max delay",
+			cfg:  Config{Delay: time.Nanosecond, MaxDelayFunc: func(int, time.Duration) time.Duration { return -1 }},
+			fn:   func(ctx context.Context) error { return ErrRetry{errDoItAgain} },
+			want: []giveUp{{GiveUpInvalidDelay, ErrRetry{errDoItAgain}, 1}},
+		},
+		{
+			name: "negative delay ceiling",
+			cfg:  Config{Delay: time.Nanosecond, DelayCeilingFunc: func(time.Time) time.Duration { return -1 }},
+			fn:   func(ctx context.Context) error { return ErrRetry{errDoItAgain} },
+			want: []giveUp{{GiveUpInvalidDelay, ErrRetry{errDoItAgain}, 1}},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			var got []giveUp
+			tc.cfg.OnGiveUp = func(reason GiveUpReason, lastErr error, attempts int) {
+				got = append(got, giveUp{reason, lastErr, attempts})
+			}
+			ctx := tc.ctx
+			if ctx == nil {
+				ctx = context.Background()
+			}
+			_ = Do(ctx, tc.cfg, tc.fn)
+			if !slices.Equal(got, tc.want) {
+				t.Errorf("OnGiveUp calls were supposed to be %v, got %v", tc.want, got)
+			}
+		})
+	}
+}
+
+func TestDelayMiddlewares(t *testing.T) {
+	var delays []time.Duration
+	timeAfter := func(t time.Duration) <-chan time.Time {
+		delays = append(delays, t)
+		return time.After(0)
+	}
+
+	cfg := Config{
+		Delay:  time.Second,
+		Scale:  2,
+		Jitter: NoJitter,
+		DelayMiddlewares: []DelayMiddleware{
+			ImmediateFirstRetries(1),
+			func(attempt int, delay time.Duration) time.Duration { return delay + time.Second },
+			CapDelay(4 * time.Second),
+			FloorDelay(1500 * time.Millisecond),
+		},
+		timeAfter: timeAfter,
+	}
+
+	var fnCalled int
+	err := Do(context.Background(), cfg, func(ctx context.Context) error {
+		fnCalled++
+		if fnCalled == 5 {
+			return nil
+		}
+		return ErrRetry{errors.New("do it again")}
+	})
+	if err != nil {
+		t.Fatalf("Do was supposed to return successfully, returned %v", err)
+	}
+
+	expectedDelays := []time.Duration{
+		1500 * time.Millisecond, // 1s -> 0 -> 1s -> 1s -> 1.5s
+		3 * time.Second,         // 2s -> 2s -> 3s -> 3s -> 3s
+		4 * time.Second,         // 4s -> 4s -> 5s -> 4s -> 4s
+		4 * time.Second,         // 8s -> 8s -> 9s -> 4s -> 4s
+	}
+	if !slices.Equal(delays, expectedDelays) {
+		t.Errorf("Delays were supposed to be %v, got %v", expectedDelays, delays)
+	}
+}
+
+func TestFirstDelay(t *testing.T) {
+	var delays []time.Duration
+	timeAfter := func(t time.Duration) <-chan time.Time {
+		delays = append(delays, t)
+		return time.After(0)
+	}
+
+	cfg := Config{
+		FirstDelay: 50 * time.Millisecond,
+		Delay:      time.Second,
+		Scale:      2,
+		Jitter:     NoJitter,
+		timeAfter:  timeAfter,
+	}
+
+	var fnCalled int
+	err := Do(context.Background(), cfg, func(ctx context.Context) error {
+		fnCalled++
+		switch fnCalled {
+		case 3:
+			return ErrRestart{errors.New("start over")}
+		case 6:
+			return nil
+		}
+		return ErrRetry{errors.New("do it again")}
+	})
+	if err != nil {
+		t.Fatalf("Do was supposed to return successfully, returned %v", err)
+	}
+
+	expectedDelays := []time.Duration{
+		50 * time.Millisecond, time.Second,
+		50 * time.Millisecond, time.Second, 2 * time.Second,
+	}
+	if !slices.Equal(delays, expectedDelays) {
+		t.Errorf("Delays were supposed to be %v, got %v", expectedDelays, delays)
+	}
+}
+
+func TestLogGiveUp(t *testing.T) {
+	errPermanent := errors.New("permanent")
+	for _, logGiveUp := range []bool{false, true} {
+		t.Run(fmt.Sprint(logGiveUp), func(t *testing.T) {
+			h := &recordingHandler{}
+			cfg := Config{
+				Delay:     time.Nanosecond,
+				Logger:    slog.New(h),
+				LogGiveUp: logGiveUp,
+			}
+
+			var fnCalled int
+			err := Do(context.Background(), cfg, func(ctx context.Context) error {
+				fnCalled++
+				if fnCalled == 2 {
+					return errPermanent
+				}
+				return ErrRetry{errors.New("transient")}
+			})
+			if err != errPermanent {
+				t.Fatalf("Do was supposed to return %v, returned %v", errPermanent, err)
+			}
+
+			expected := []string{"transient"}
+			if logGiveUp {
+				expected = append(expected, "permanent")
+			}
+			if logged := h.loggedErrors(); !slices.Equal(logged, expected) {
+				t.Fatalf("Logged errors were supposed to be %v, got %v", expected, logged)
+			}
+			if logGiveUp && h.records[1].Message != "giving up" {
+				t.Errorf("Give up message was supposed to be %q, got %q", "giving up", h.records[1].Message)
+			}
+		})
+	}
+}
+
+func TestHeartbeat(t *testing.T) {
+	const interval = 300 * time.Millisecond
+
+	// Fake clock: a delay request replaces the pending timers, and each
+	// heartbeat request fires the earliest pending timer, so exactly one
+	// channel is ready whenever Do blocks
+	type timer struct {
+		at time.Time
+		ch chan time.Time
+	}
+	now := time.Unix(0, 0)
+	var timers []timer
+	timeAfter := func(d time.Duration) <-chan time.Time {
+		ch := make(chan time.Time, 1)
+		if d != interval {
+			timers = nil
+		}
+		timers = append(timers, timer{at: now.Add(d), ch: ch})
+		if d == interval {
+			earliest := 0
+			for i, tm := range timers {
+				if tm.at.Before(timers[earliest].at) {
+					earliest = i
+				}
+			}
+			now = timers[earliest].at
+			timers[earliest].ch <- now
+			timers = slices.Delete(timers, earliest, earliest+1)
+		}
+		return ch
+	}
+
+	var remaining []time.Duration
+	cfg := Config{
+		Delay:  time.Second,
+		Scale:  2,
+		Jitter: NoJitter,
+		Heartbeat: Heartbeat{
+			Interval: interval,
+			Fn:       func(r time.Duration) { remaining = append(remaining, r) },
+		},
+		timeAfter: timeAfter,
+		now:       func() time.Time { return now },
+	}
+
+	var fnCalled int
+	err := Do(context.Background(), cfg, func(ctx context.Context) error {
+		fnCalled++
+		if fnCalled == 3 {
+			return nil
+		}
+		return ErrRetry{errors.New("do it again")}
+	})
+	if err != nil {
+		t.Fatalf("Do was supposed to return successfully, returned %v", err)
+	}
+
+	ms := time.Millisecond
+	expected := []time.Duration{
+		700 * ms, 400 * ms, 100 * ms, // 1s delay
+		1700 * ms, 1400 * ms, 1100 * ms, 800 * ms, 500 * ms, 200 * ms, // 2s delay
+	}
+	if !slices.Equal(remaining, expected) {
+		t.Errorf("Heartbeats were supposed to report %v, got %v", expected, remaining)
+	}
+}
+
+func TestDoTrace(t *testing.T) {
+	now := time.Unix(0, 0)
+	cfg := Config{
+		Delay:  time.Second,
+		Scale:  2,
+		Jitter: NoJitter,
+		timeAfter: func(d time.Duration) <-chan time.Time {
+			now = now.Add(d)
+			return time.After(0)
+		},
+		now: func() time.Time { return now },
+	}
+
+	errs := []error{
+		ErrRetry{errors.New("a")},
+		ErrRestart{errors.New("b")},
+		ErrRetry{errors.New("c")},
+		nil,
+	}
+	var fnCalled int
+	trace, err := DoTrace(context.Background(), cfg, func(ctx context.Context) error {
+		now = now.Add(100 * time.Millisecond)
+		fnCalled++
+		return errs[fnCalled-1]
+	})
+	if err != nil {
+		t.Fatalf("DoTrace was supposed to return successfully, returned %v", err)
+	}
+
+	start := time.Unix(0, 0)
+	ms := time.Millisecond
+	expected := Trace{
+		{Num: 1, Err: errs[0], Started: start, Duration: 100 * ms},
+		{Num: 2, Err: errs[1], Started: start.Add(1100 * ms), Duration: 100 * ms, DelayBefore: time.Second},
+		{Num: 3, Err: errs[2], Started: start.Add(2200 * ms), Duration: 100 * ms, DelayBefore: time.Second},
+		{Num: 4, Err: nil, Started: start.Add(4300 * ms), Duration: 100 * ms, DelayBefore: 2 * time.Second},
+	}
+	if !slices.Equal(trace, expected) {
+		t.Errorf("Trace was supposed to be %v, got %v", expected, trace)
+	}
+}
+
+func TestOnRetryDecide(t *testing.T) {
+	errDoItAgain := errors.New("do it again")
+	var decisions []int
+	var reason GiveUpReason
+	cfg := Config{
+		Delay:  time.Nanosecond,
+		Jitter: NoJitter,
+		OnRetryDecide: func(attempt int, delay time.Duration, err error) bool {
+			if delay != time.Nanosecond || err != errDoItAgain {
+				t.Errorf("OnRetryDecide was supposed to be called with %v, %v, called with %v, %v",
+					time.Nanosecond, errDoItAgain, delay, err)
+			}
+			decisions = append(decisions, attempt)
+			return attempt < 3
+		},
+		OnGiveUp: func(r GiveUpReason, _ error, _ int) { reason = r },
+	}
+
+	var fnCalled int
+	err := Do(context.Background(), cfg, func(ctx context.Context) error {
+		fnCalled++
+		return ErrRetry{errDoItAgain}
+	})
+	if err != errDoItAgain {
+		t.Fatalf("Do was supposed to return %v, returned %v", errDoItAgain, err)
+	}
+	if fnCalled != 3 {
+		t.Errorf("fn was supposed to be called %d times, called %d times", 3, fnCalled)
+	}
+	if expected := []int{1, 2, 3}; !slices.Equal(decisions, expected) {
+		t.Errorf("OnRetryDecide was supposed to be called for attempts %v, called for %v", expected, decisions)
+	}
+	if reason != GiveUpDeclined {
+		t.Errorf("Give up reason was supposed to be %v, got %v", GiveUpDeclined, reason)
+	}
+}
+
+func TestDoUntil(t *testing.T) {
+	now := time.Unix(0, 0)
+	cfg := Config{
+		Delay: time.Millisecond,
+		now:   func() time.Time { return now },
+	}
+
+	t.Run("past", func(t *testing.T) {
+		var fnCalled int
+		err := DoUntil(context.Background(), cfg, now.Add(-time.Second), func(ctx context.Context) error {
+			fnCalled++
+			return nil
+		})
+		if !errors.Is(err, context.DeadlineExceeded) {
+			t.Fatalf("DoUntil was supposed to return %v, returned %v", context.DeadlineExceeded, err)
+		}
+		if fnCalled != 0 {
+			t.Errorf("fn was supposed to be called %d times, called %d times", 0, fnCalled)
+		}
+	})
+
+	t.Run("future", func(t *testing.T) {
+		clock := newManualClock()
+		cfg := clock.config(Config{Delay: time.Millisecond, Jitter: NoJitter})
+		var fnCalled int
+		err := DoUntil(context.Background(), cfg, clock.now().Add(5*time.Millisecond), func(ctx context.Context) error {
+			fnCalled++
+			if _, ok := ctx.Deadline(); !ok {
+				t.Errorf("fn was supposed to receive context with deadline")
+			}
+			return ErrRestart{errors.New("start over")}
+		})
+		if !errors.Is(err, context.DeadlineExceeded) {
+			t.Fatalf("DoUntil was supposed to return %v, returned %v", context.DeadlineExceeded, err)
+		}
+		// Attempts at 0, 1, 2, 3 and 4ms, the deadline is reached while
+		// waiting for the next one
+		if fnCalled != 5 {
+			t.Errorf("fn was supposed to be called %d times, called %d times", 5, fnCalled)
+		}
+	})
+}
+
+func TestRetriableLoud(t *testing.T) {
+	h := &recordingHandler{}
+	cfg := Config{Delay: time.Nanosecond, Logger: slog.New(h)}
+
+	errAuth := errors.New("auth")
+	errs := []error{
+		ErrRetry{errors.New("a")},
+		RetriableLoud(errAuth),
+		RetriableLoud(errAuth), // identical, not logged
+		ErrRetry{errAuth},      // same message, but not loud
+		RetriableLoud(errAuth),
+		nil,
+	}
+	var fnCalled int
+	err := Do(context.Background(), cfg, func(ctx context.Context) error {
+		fnCalled++
+		return errs[fnCalled-1]
+	})
+	if err != nil {
+		t.Fatalf("Do was supposed to return successfully, returned %v", err)
+	}
+
+	expected := []slog.Level{slog.LevelDebug, slog.LevelError, slog.LevelDebug, slog.LevelError}
+	var levels []slog.Level
+	for _, r := range h.records {
+		levels = append(levels, r.Level)
+	}
+	if !slices.Equal(levels, expected) {
+		t.Errorf("Log levels were supposed to be %v, got %v", expected, levels)
+	}
+
+	cfg.NoRetry = true
+	err = Do(context.Background(), cfg, func(ctx context.Context) error {
+		return RetriableLoud(errAuth)
+	})
+	if err != errAuth {
+		t.Errorf("Do was supposed to return %v unwrapped, returned %#v", errAuth, err)
+	}
+}
+
+type requestIDKey struct{}
+
+func TestSeedFromContext(t *testing.T) {
+	var delays []time.Duration
+	cfg := Config{
+		Delay: time.Second,
+		Scale: 2,
+		SeedFromContext: func(ctx context.Context) (int64, bool) {
+			id, ok := ctx.Value(requestIDKey{}).(int64)
+			return id, ok
+		},
+		timeAfter: func(d time.Duration) <-chan time.Time {
+			delays = append(delays, d)
+			return time.After(0)
+		},
+	}
+
+	run := func(ctx context.Context) []time.Duration {
+		delays = nil
+		var fnCalled int
+		err := Do(ctx, cfg, func(ctx context.Context) error {
+			fnCalled++
+			if fnCalled == 5 {
+				return nil
+			}
+			return ErrRetry{errors.New("do it again")}
+		})
+		if err != nil {
+			t.Fatalf("Do was supposed to return successfully, returned %v", err)
+		}
+		return delays
+	}
+
+	first := run(context.WithValue(context.Background(), requestIDKey{}, int64(42)))
+	second := run(context.WithValue(context.Background(), requestIDKey{}, int64(42)))
+	if !slices.Equal(first, second) {
+		t.Errorf("Delays for the same seed were supposed to be equal, got %v and %v", first, second)
+	}
+	other := run(context.WithValue(context.Background(), requestIDKey{}, int64(43)))
+	if slices.Equal(first, other) {
+		t.Errorf("Delays for different seeds were supposed to differ, got %v twice", first)
+	}
+}
+
+func TestFreshContextPerAttempt(t *testing.T) {
+	for _, fresh := range []bool{false, true} {
+		t.Run(fmt.Sprint(fresh), func(t *testing.T) {
+			cfg := Config{
+				Delay:                  time.Nanosecond,
+				Timeout:                time.Hour,
+				FreshContextPerAttempt: fresh,
+			}
+
+			var ctxs []context.Context
+			err := Do(context.Background(), cfg, func(ctx context.Context) error {
+				ctxs = append(ctxs, ctx)
+				if len(ctxs) == 1 {
+					return ErrRetry{errors.New("do it again")}
+				}
+				if _, ok := ctx.Deadline(); !ok {
+					t.Errorf("Attempt context was supposed to have a deadline")
+				}
+				if err := ctxs[0].Err(); (err != nil) != fresh {
+					t.Errorf("Context of the previous attempt was supposed to be done: %v, got error %v", fresh, err)
+				}
+				return nil
+			})
+			if err != nil {
+				t.Fatalf("Do was supposed to return successfully, returned %v", err)
+			}
+			if (ctxs[0] != ctxs[1]) != fresh {
+				t.Errorf("Attempts were supposed to receive distinct contexts: %v", fresh)
+			}
+		})
+	}
+}
+
+func TestDefault(t *testing.T) {
+	saved := Default()
+	defer func() {
+		if err := SetDefault(saved); err != nil {
+			t.Fatalf("SetDefault was supposed to restore the default, returned %v", err)
+		}
+	}()
+
+	if err := SetDefault(Config{}); err == nil {
+		t.Fatalf("SetDefault was supposed to reject invalid config")
+	}
+	if err := SetDefault(Config{Delay: time.Second, Rand: rand.New(rand.NewSource(1))}); err == nil {
+		t.Fatalf("SetDefault was supposed to reject config with Rand")
+	}
+	if Default().Delay != time.Second {
+		t.Fatalf("Invalid config was not supposed to replace the default, got %v", Default())
+	}
+
+	var delays []time.Duration
+	if err := SetDefault(Config{Delay: 2 * time.Second, Jitter: NoJitter, timeAfter: func(d time.Duration) <-chan time.Time {
+		delays = append(delays, d)
+		return time.After(0)
+	}}); err != nil {
+		t.Fatalf("SetDefault was supposed to accept valid config, returned %v", err)
+	}
+
+	cfg := Default()
+	cfg.Delay = time.Hour
+	if Default().Delay != 2*time.Second {
+		t.Fatalf("Modifying a returned config was not supposed to change the default")
+	}
+
+	var fnCalled int
+	err := DoDefault(context.Background(), func(ctx context.Context) error {
+		fnCalled++
+		if fnCalled == 2 {
+			return nil
+		}
+		return ErrRetry{errors.New("do it again")}
+	})
+	if err != nil {
+		t.Fatalf("DoDefault was supposed to return successfully, returned %v", err)
+	}
+	if expected := []time.Duration{2 * time.Second}; !slices.Equal(delays, expected) {
+		t.Errorf("Delays were supposed to be %v, got %v", expected, delays)
+	}
+}
+
+func TestMaxConsecutiveSameError(t *testing.T) {
+	errA := errors.New("a")
+	errB := errors.New("b")
+	errs := []error{
+		ErrRetry{errA},
+		ErrRetry{errA},
+		ErrRetry{errB}, // resets the count
+		ErrRetry{errB},
+		ErrRestart{errB}, // resets the count
+		ErrRetry{errB},
+		ErrRetry{errB},
+		ErrRetry{errB}, // third in a row
+		nil,
+	}
+
+	var reason GiveUpReason
+	cfg := Config{
+		Delay:                   time.Nanosecond,
+		MaxConsecutiveSameError: 3,
+		OnGiveUp:                func(r GiveUpReason, _ error, _ int) { reason = r },
+	}
+	var fnCalled int
+	err := Do(context.Background(), cfg, func(ctx context.Context) error {
+		fnCalled++
+		return errs[fnCalled-1]
+	})
+	if err != errB {
+		t.Fatalf("Do was supposed to return %v, returned %v", errB, err)
+	}
+	if fnCalled != 8 {
+		t.Errorf("fn was supposed to be called %d times, called %d times", 8, fnCalled)
+	}
+	if reason != GiveUpRepeatedError {
+		t.Errorf("Give up reason was supposed to be %v, got %v", GiveUpRepeatedError, reason)
+	}
+}
+
+// fullConfig returns a config with all fields set
+func fullConfig() Config {
+	preDelayCtx, cancel := context.WithCancel(context.Background())
+	cancel()
+	return Config{
+		Delay:                   time.Second,
+		Scale:                   2,
+		FirstDelay:              time.Millisecond,
+		BackoffSchedule:         []BackoffPhase{{Delay: time.Second}},
+		Jitter:                  0.5,
+		JitterAttempts:          1,
+		JitterFloorFraction:     0.1,
+		MaxJitterAbsolute:       time.Second,
+		PreDelay:                time.Second,
+		ContextFactory:          context.Background,
+		PreDelayBestEffort:      true,
+		PreDelayCtx:             preDelayCtx,
+		MaxDelay:                time.Minute,
+		NextDelay:               func(int, time.Duration, error) time.Duration { return 0 },
+		NextDelayUncapped:       true,
+		DelayMiddlewares:        []DelayMiddleware{CapDelay(time.Second)},
+		MaxDelayFunc:            func(int, time.Duration) time.Duration { return 0 },
+		DelayCeilingFunc:        func(time.Time) time.Duration { return 0 },
+		StopAtMaxDelay:          true,
+		MaxDelayStreak:          1,
+		OnDegraded:              func() {},
+		MaxDelayJitter:          time.Second,
+		Heartbeat:               Heartbeat{Interval: time.Second, Fn: func(time.Duration) {}},
+		InterruptOn:             []<-chan struct{}{make(chan struct{})},
+		Limiter:                 &stubLimiter{},
+		Timeout:                 time.Hour,
+		CleanTimeoutError:       true,
+		NoRetry:                 true,
+		MaxTotalAttempts:        1,
+		RetryOn:                 []error{io.EOF},
+		StopOn:                  []error{io.ErrUnexpectedEOF},
+		TransientErrors:         make(chan error),
+		AttemptContext:          func(ctx context.Context, _ int) (context.Context, func()) { return ctx, func() {} },
+		Refresh:                 func(context.Context) error { return nil },
+		RefreshOn:               func(error) bool { return true },
+		FreshContextPerAttempt:  true,
+		OnFirstAttempt:          func(context.Context) {},
+		WaitFor:                 func(context.Context) error { return nil },
+		OnAttemptEnd:            func(int, time.Duration, error) {},
+		OnRetryDecide:           func(int, time.Duration, error) bool { return true },
+		OnScheduled:             func(time.Duration, time.Time) {},
+		MaxConsecutiveSameError: 1,
+		JoinDistinctErrors:      true,
+		OnGiveUp:                func(GiveUpReason, error, int) {},
+		OnExhausted:             func(error, int) error { return nil },
+		RetryOnCtxError:         true,
+		Name:                    "op",
+		Group:                   &Group{},
+		SlowAttemptThreshold:    time.Second,
+		Logger:                  NoLog,
+		LogDedupKey:             errorString,
+		LogLevel:                slog.LevelWarn,
+		FirstErrorLogLevel:      slog.LevelError,
+		LogSampleEvery:          2,
+		LogContextAttrs:         func(context.Context) []slog.Attr { return nil },
+		LogTransitionsOnly:      true,
+		LogGiveUp:               true,
+		Rand:                    rand.New(rand.NewSource(1)),
+		SeedFromContext:         func(context.Context) (int64, bool) { return 0, false },
+		RandObserver:            func(float64) {},
+		StrictValidate:          true,
+		AllowZeroDelay:          true,
+		timeAfter:               time.After,
+		timeoutAfter:            time.After,
+		now:                     time.Now,
+	}
+}
+
+// differentFields returns the names of fields that differ between a and b,
+// comparing functions, slices and pointers by identity
+func differentFields(a, b Config) []string {
+	var same func(x, y reflect.Value) bool
+	same = func(x, y reflect.Value) bool {
+		switch x.Kind() {
+		case reflect.Func, reflect.Slice, reflect.Chan, reflect.Pointer, reflect.Interface:
+			if x.Kind() == reflect.Interface {
+				return x.IsNil() == y.IsNil() && (x.IsNil() || same(x.Elem(), y.Elem()))
+			}
+			return x.Pointer() == y.Pointer() && (x.Kind() != reflect.Slice || x.Len() == y.Len())
+		case reflect.Struct:
+			for i := range x.NumField() {
+				if !same(x.Field(i), y.Field(i)) {
+					return false
+				}
+			}
+			return true
+		default:
+			return x.Equal(y)
+		}
+	}
+
+	va, vb := reflect.ValueOf(a), reflect.ValueOf(b)
+	var out []string
+	for i := range va.NumField() {
+		if !same(va.Field(i), vb.Field(i)) {
+			out = append(out, va.Type().Field(i).Name)
+		}
+	}
+	return out
+}
+
+func TestMerge(t *testing.T) {
+	full := fullConfig()
+	v := reflect.ValueOf(full)
+	for i := range v.NumField() {
+		if v.Field(i).IsZero() {
+			t.Fatalf("Field %s is not set in fullConfig", v.Type().Field(i).Name)
+		}
+	}
+
+	if diff := differentFields(full.Merge(Config{}), full); diff != nil {
+		t.Errorf("Empty override was supposed to keep all fields, changed %v", diff)
+	}
+	if diff := differentFields(Config{}.Merge(full), full); diff != nil {
+		t.Errorf("Override was supposed to replace all fields, kept %v", diff)
+	}
+
+	base := Config{Delay: time.Second, Jitter: 0.5, Timeout: time.Minute, NoRetry: true}
+	override := Config{Delay: 2 * time.Second, Jitter: NoJitter}
+	expected := Config{Delay: 2 * time.Second, Jitter: NoJitter, Timeout: time.Minute, NoRetry: true}
+	if diff := differentFields(base.Merge(override), expected); diff != nil {
+		t.Errorf("Merged config differs from expected in %v", diff)
+	}
+
+	// Zero values do not reset fields to defaults
+	if merged := base.Merge(Config{Jitter: 0, NoRetry: false}); merged.Jitter != 0.5 || !merged.NoRetry {
+		t.Errorf("Zero fields of override were not supposed to replace fields of base")
+	}
+}
+
+func TestLogSampleEvery(t *testing.T) {
+	h := &recordingHandler{}
+	cfg := Config{Delay: time.Nanosecond, Logger: slog.New(h), LogSampleEvery: 3}
+
+	errs := []error{
+		ErrRetry{errors.New("1")}, // first
+		ErrRetry{errors.New("2")},
+		ErrRetry{errors.New("2")}, // duplicate, not counted
+		ErrRetry{errors.New("3")}, // third
+		ErrRetry{errors.New("4")},
+		ErrRetry{errors.New("5")},
+		ErrRetry{errors.New("6")}, // sixth
+		ErrRestart{errors.New("7")},
+		ErrRetry{errors.New("8")}, // first after restart
+		ErrRetry{errors.New("9")},
+		nil,
+	}
+	var fnCalled int
+	err := Do(context.Background(), cfg, func(ctx context.Context) error {
+		fnCalled++
+		return errs[fnCalled-1]
+	})
+	if err != nil {
+		t.Fatalf("Do was supposed to return successfully, returned %v", err)
+	}
+
+	expected := []string{"1", "3", "6", "8"}
+	if logged := h.loggedErrors(); !slices.Equal(logged, expected) {
+		t.Errorf("Logged errors were supposed to be %v, got %v", expected, logged)
+	}
+}
+
+func TestTimeoutInFnPreservesError(t *testing.T) {
+	for _, wrap := range []func(error) error{
+		func(err error) error { return err },
+		Retriable,
+	} {
+		cfg := Config{Delay: 100 * time.Hour, Timeout: 10 * time.Millisecond}
+		err := Do(context.Background(), cfg, func(ctx context.Context) error {
+			<-ctx.Done()
+			return wrap(fmt.Errorf("reading response: %w", ctx.Err()))
+		})
+		if !errors.Is(err, context.DeadlineExceeded) {
+			t.Fatalf("Do was supposed to return 'deadline exceeded', returned %v", err)
+		}
+		if expected := "reading response: context deadline exceeded"; err.Error() != expected {
+			t.Errorf("Do was supposed to return %q, returned %q", expected, err.Error())
+		}
+	}
+}
+
+func TestRefresh(t *testing.T) {
+	errUnauthorized := errors.New("unauthorized")
+	errRefresh := errors.New("refresh failed")
+
+	t.Run("matching errors", func(t *testing.T) {
+		var refreshed []int
+		var fnCalled int
+		cfg := Config{
+			Delay: time.Nanosecond,
+			Refresh: func(ctx context.Context) error {
+				refreshed = append(refreshed, fnCalled)
+				return nil
+			},
+			RefreshOn: func(err error) bool { return err == errUnauthorized },
+		}
+		errs := []error{
+			ErrRetry{errors.New("unavailable")},
+			ErrRetry{errUnauthorized},
+			ErrRestart{errUnauthorized},
+			nil,
+		}
+		err := Do(context.Background(), cfg, func(ctx context.Context) error {
+			fnCalled++
+			return errs[fnCalled-1]
+		})
+		if err != nil {
+			t.Fatalf("Do was supposed to return successfully, returned %v", err)
+		}
+		if expected := []int{2, 3}; !slices.Equal(refreshed, expected) {
+			t.Errorf("Refresh was supposed to be called after attempts %v, called after %v", expected, refreshed)
+		}
+	})
+
+	t.Run("failure", func(t *testing.T) {
+		var reason GiveUpReason
+		cfg := Config{
+			Delay:    time.Nanosecond,
+			Refresh:  func(ctx context.Context) error { return errRefresh },
+			OnGiveUp: func(r GiveUpReason, _ error, _ int) { reason = r },
+		}
+		var fnCalled int
+		err := Do(context.Background(), cfg, func(ctx context.Context) error {
+			fnCalled++
+			return ErrRetry{errUnauthorized}
+		})
+		if err != errRefresh {
+			t.Fatalf("Do was supposed to return %v, returned %v", errRefresh, err)
+		}
+		if fnCalled != 1 {
+			t.Errorf("fn was supposed to be called %d times, called %d times", 1, fnCalled)
+		}
+		if reason != GiveUpRefreshFailed {
+			t.Errorf("Give up reason was supposed to be %v, got %v", GiveUpRefreshFailed, reason)
+		}
+	})
+}
+
+func TestMaxTotalAttempts(t *testing.T) {
+	errLast := errors.New("last")
+	var reason GiveUpReason
+	cfg := Config{
+		Delay:            time.Nanosecond,
+		MaxTotalAttempts: 5,
+		OnGiveUp:         func(r GiveUpReason, _ error, _ int) { reason = r },
+	}
+
+	var fnCalled int
+	err := Do(context.Background(), cfg, func(ctx context.Context) error {
+		fnCalled++
+		switch {
+		case fnCalled == 5:
+			return ErrRetry{errLast}
+		case fnCalled%2 == 0:
+			return ErrRestart{errors.New("start over")}
+		default:
+			return ErrRetry{errors.New("do it again")}
+		}
+	})
+	if !errors.Is(err, ErrTotalAttemptsExhausted) || !errors.Is(err, errLast) {
+		t.Fatalf("Do was supposed to return %v wrapped with %v, returned %v", errLast, ErrTotalAttemptsExhausted, err)
+	}
+	if fnCalled != 5 {
+		t.Errorf("fn was supposed to be called %d times, called %d times", 5, fnCalled)
+	}
+	if reason != GiveUpMaxAttempts {
+		t.Errorf("Give up reason was supposed to be %v, got %v", GiveUpMaxAttempts, reason)
+	}
+}
+
+func TestLogTransitionsOnly(t *testing.T) {
+	errFatal := errors.New("fatal")
+	for _, tc := range []struct {
+		name     string
+		errs     []error
+		expected []string
+	}{
+		{
+			name:     "success",
+			errs:     []error{nil},
+			expected: nil,
+		},
+		{
+			name:     "recovery",
+			errs:     []error{ErrRetry{errors.New("a")}, ErrRestart{errors.New("b")}, ErrRetry{errors.New("c")}, nil},
+			expected: []string{"entering retry error=a", "recovered attempts=4"},
+		},
+		{
+			name:     "give up",
+			errs:     []error{ErrRetry{errors.New("a")}, ErrRetry{errors.New("b")}, errFatal},
+			expected: []string{"entering retry error=a", "giving up error=fatal reason=permanent error"},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			h := &recordingHandler{}
+			cfg := Config{Delay: time.Nanosecond, Logger: slog.New(h), LogTransitionsOnly: true}
+
+			var fnCalled int
+			_ = Do(context.Background(), cfg, func(ctx context.Context) error {
+				fnCalled++
+				return tc.errs[fnCalled-1]
+			})
+
+			var lines []string
+			for _, r := range h.records {
+				line := r.Message
+				r.Attrs(func(a slog.Attr) bool {
+					line += " " + a.String()
+					return true
+				})
+				lines = append(lines, line)
+			}
+			if !slices.Equal(lines, tc.expected) {
+				t.Errorf("Log lines were supposed to be %q, got %q", tc.expected, lines)
+			}
+		})
+	}
+}
+
+func TestAttemptTimeoutClampedByTimeout(t *testing.T) {
+	clock := newManualClock()
+	cfg := clock.config(Config{
+		Delay:   4 * time.Millisecond,
+		Jitter:  NoJitter,
+		Timeout: 10 * time.Millisecond,
+		AttemptContext: func(ctx context.Context, attempt int) (context.Context, func()) {
+			// The deadline of the attempt follows the clock, the attempt
+			// itself never times out
+			return withTimeout(ctx, 4*time.Millisecond, func(time.Duration) <-chan time.Time { return nil }, clock.now)
+		},
+	})
+
+	var deadlines []time.Time
+	start := clock.now()
+	err := Do(context.Background(), cfg, func(ctx context.Context) error {
+		deadline, _ := ctx.Deadline()
+		deadlines = append(deadlines, deadline)
+		if len(deadlines) == 3 {
+			return nil
+		}
+		return ErrRetry{errors.New("do it again")}
+	})
+	if err != nil {
+		t.Fatalf("Do was supposed to return successfully, returned %v", err)
+	}
+
+	// The last attempt starts with 2ms of Timeout left
+	expectedDeadlines := []time.Time{
+		start.Add(4 * time.Millisecond),
+		start.Add(8 * time.Millisecond),
+		start.Add(10 * time.Millisecond),
+	}
+	if !slices.Equal(deadlines, expectedDeadlines) {
+		t.Errorf("Attempt deadlines were supposed to be %v, got %v", expectedDeadlines, deadlines)
+	}
+}
+
+func TestDo1ValueOnError(t *testing.T) {
+	errFatal := errors.New("fatal")
+	errDoItAgain := errors.New("do it again")
+
+	t.Run("non-retriable error", func(t *testing.T) {
+		val, err := Do1(context.Background(), Config{Delay: time.Nanosecond}, func(ctx context.Context) (int, error) {
+			return 42, errFatal
+		})
+		if val != 42 || err != errFatal {
+			t.Errorf("Do1 was supposed to return (42, %v), returned (%d, %v)", errFatal, val, err)
+		}
+	})
+	t.Run("retriable error", func(t *testing.T) {
+		var fnCalled int
+		val, err := Do1(context.Background(), Config{Delay: time.Nanosecond, MaxTotalAttempts: 2}, func(ctx context.Context) (int, error) {
+			fnCalled++
+			return fnCalled, ErrRetry{errDoItAgain}
+		})
+		if val != 2 || !errors.Is(err, errDoItAgain) {
+			t.Errorf("Do1 was supposed to return the value of the last attempt (2, %v), returned (%d, %v)", errDoItAgain, val, err)
+		}
+	})
+	t.Run("not called", func(t *testing.T) {
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+		val, err := Do1(ctx, Config{Delay: time.Nanosecond}, func(ctx context.Context) (int, error) {
+			return 42, nil
+		})
+		if val != 0 || err != context.Canceled {
+			t.Errorf("Do1 was supposed to return (0, %v), returned (%d, %v)", context.Canceled, val, err)
+		}
+	})
+}
+
+func TestJitterFloorFraction(t *testing.T) {
+	var delays []time.Duration
+	cfg := Config{
+		Delay:               time.Second,
+		Jitter:              0.5,
+		JitterFloorFraction: 0.1,
+		Rand:                rand.New(rand.NewSource(1)),
+		timeAfter: func(d time.Duration) <-chan time.Time {
+			delays = append(delays, d)
+			return time.After(0)
+		},
+	}
+
+	var fnCalled int
+	err := Do(context.Background(), cfg, func(ctx context.Context) error {
+		fnCalled++
+		if fnCalled == 1000 {
+			return nil
+		}
+		return ErrRetry{errors.New("do it again")}
+	})
+	if err != nil {
+		t.Fatalf("Do was supposed to return successfully, returned %v", err)
+	}
+
+	var below, above int
+	for _, d := range delays {
+		spread := d - time.Second
+		if spread.Abs() < 100*time.Millisecond || spread.Abs() > 500*time.Millisecond {
+			t.Fatalf("Delay %v is not within [100ms,500ms] of the base delay", d)
+		}
+		if spread < 0 {
+			below++
+		} else {
+			above++
+		}
+	}
+	if below < 400 || above < 400 {
+		t.Errorf("Delays were supposed to be spread on both sides, got %d below and %d above", below, above)
+	}
+
+	for _, tc := range []struct {
+		rnd  float64
+		want time.Duration
+	}{
+		{0, 500 * time.Millisecond},
+		{0.25, 700 * time.Millisecond},
+		{0.5, 1100 * time.Millisecond},
+		{0.75, 1300 * time.Millisecond},
+	} {
+		if got := applyJitterFloor(time.Second, 0.5, 0.1, tc.rnd); got != tc.want {
+			t.Errorf("applyJitterFloor(1s, 0.5, 0.1, %v) = %v, want %v", tc.rnd, got, tc.want)
+		}
+	}
+}
+
+func TestInterruptOn(t *testing.T) {
+	a := make(chan struct{}, 1)
+	b := make(chan struct{}, 1)
+	cfg := Config{
+		Delay:       100 * time.Hour,
+		Timeout:     time.Minute,
+		InterruptOn: []<-chan struct{}{a, b},
+	}
+
+	var fnCalled int
+	err := Do(context.Background(), cfg, func(ctx context.Context) error {
+		fnCalled++
+		switch fnCalled {
+		case 1:
+			a <- struct{}{}
+		case 2:
+			b <- struct{}{}
+		default:
+			return nil
+		}
+		return ErrRetry{errors.New("do it again")}
+	})
+	if err != nil {
+		t.Fatalf("Do was supposed to return successfully, returned %v", err)
+	}
+	if fnCalled != 3 {
+		t.Errorf("fn was supposed to be called %d times, called %d times", 3, fnCalled)
+	}
+
+	// Interrupts do not stop the retries, only the context does
+	ctx, cancel := context.WithCancel(context.Background())
+	err = Do(ctx, cfg, func(ctx context.Context) error {
+		cancel()
+		select {
+		case a <- struct{}{}:
+		default:
+		}
+		return ErrRetry{errors.New("do it again")}
+	})
+	if !errors.Is(err, context.Canceled) {
+		t.Errorf("Do was supposed to return %v, returned %v", context.Canceled, err)
+	}
+}
+
+func TestPresets(t *testing.T) {
+	for name, preset := range map[string]func() Config{
+		"Aggressive":     Aggressive,
+		"NetworkDefault": NetworkDefault,
+		"Gentle":         Gentle,
+	} {
+		t.Run(name, func(t *testing.T) {
+			cfg := preset()
+			if err := cfg.Validate(); err != nil {
+				t.Fatalf("Preset was supposed to be valid, Validate returned %v", err)
+			}
+			cfg.Delay = time.Hour
+			if preset().Delay == time.Hour {
+				t.Errorf("Modifying a returned preset was not supposed to change the preset")
+			}
+		})
+	}
+}
+
+func TestPreDelayBestEffort(t *testing.T) {
+	cfg := Config{
+		Delay:              100 * time.Hour,
+		Timeout:            10 * time.Millisecond,
+		PreDelay:           100 * time.Hour,
+		PreDelayBestEffort: true,
+	}
+
+	t.Run("success", func(t *testing.T) {
+		var fnCalled int
+		err := Do(context.Background(), cfg, func(ctx context.Context) error {
+			fnCalled++
+			if err := ctx.Err(); err != nil {
+				t.Errorf("fn was supposed to receive context that is not done, got error %v", err)
+			}
+			return nil
+		})
+		if err != nil {
+			t.Fatalf("Do was supposed to return successfully, returned %v", err)
+		}
+		if fnCalled != 1 {
+			t.Errorf("fn was supposed to be called %d times, called %d times", 1, fnCalled)
+		}
+	})
+	t.Run("failure", func(t *testing.T) {
+		var fnCalled int
+		err := Do(context.Background(), cfg, func(ctx context.Context) error {
+			fnCalled++
+			return ErrRetry{errors.New("do it again")}
+		})
+		if !errors.Is(err, context.DeadlineExceeded) {
+			t.Fatalf("Do was supposed to return 'deadline exceeded', returned %v", err)
+		}
+		if fnCalled != 1 {
+			t.Errorf("fn was supposed to be called %d times, called %d times", 1, fnCalled)
+		}
+	})
+	t.Run("cancelled", func(t *testing.T) {
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+		defer cancel()
+		cfg := cfg
+		cfg.Timeout = 0
+		err := Do(ctx, cfg, func(ctx context.Context) error {
+			t.Errorf("fn was not supposed to be called once the context passed to Do is done")
+			return nil
+		})
+		if !errors.Is(err, context.DeadlineExceeded) {
+			t.Fatalf("Do was supposed to return 'deadline exceeded', returned %v", err)
+		}
+	})
+}
+
+func TestRetriableUnless(t *testing.T) {
+	terminal := func(err error) bool { return errors.Is(err, context.Canceled) }
+	errTransient := errors.New("transient")
+	wrappedCanceled := fmt.Errorf("reading: %w", context.Canceled)
+
+	if err := RetriableUnless(nil, terminal); err != nil {
+		t.Errorf("RetriableUnless was supposed to return nil for nil, returned %v", err)
+	}
+	if err := RetriableUnless(wrappedCanceled, terminal); err != wrappedCanceled {
+		t.Errorf("RetriableUnless was supposed to return %v unchanged, returned %#v", wrappedCanceled, err)
+	}
+	if err := RetriableUnless(errTransient, terminal); err != (ErrRetry{errTransient}) {
+		t.Errorf("RetriableUnless was supposed to wrap %v in ErrRetry, returned %#v", errTransient, err)
+	}
+}
+
+func TestOnDegraded(t *testing.T) {
+	var degraded []int
+	var fnCalled int
+	cfg := Config{
+		Delay:      time.Second,
+		Scale:      2,
+		MaxDelay:   4 * time.Second,
+		OnDegraded: func() { degraded = append(degraded, fnCalled) },
+		timeAfter:  func(time.Duration) <-chan time.Time { return time.After(0) },
+	}
+
+	errs := []error{
+		ErrRetry{errors.New("a")},   // 1s
+		ErrRetry{errors.New("a")},   // 2s
+		ErrRetry{errors.New("a")},   // 4s, degraded
+		ErrRetry{errors.New("a")},   // 4s
+		ErrRestart{errors.New("b")}, // 1s
+		ErrRetry{errors.New("a")},   // 2s
+		ErrRetry{errors.New("a")},   // 4s, degraded again
+		nil,
+	}
+	err := Do(context.Background(), cfg, func(ctx context.Context) error {
+		fnCalled++
+		return errs[fnCalled-1]
+	})
+	if err != nil {
+		t.Fatalf("Do was supposed to return successfully, returned %v", err)
+	}
+	if expected := []int{3, 7}; !slices.Equal(degraded, expected) {
+		t.Errorf("OnDegraded was supposed to be called after attempts %v, called after %v", expected, degraded)
+	}
+}
+
+type episodeKey struct{}
+
+func TestContextFactory(t *testing.T) {
+	var episodes int
+	cfg := Config{
+		Delay:   time.Nanosecond,
+		Timeout: time.Hour,
+		ContextFactory: func() context.Context {
+			episodes++
+			return context.WithValue(context.Background(), episodeKey{}, episodes)
+		},
+	}
+
+	ctx, cancel := context.WithCancel(context.WithValue(context.Background(), episodeKey{}, 0))
+	defer cancel()
+
+	var seen []int
+	err := Do(ctx, cfg, func(ctx context.Context) error {
+		seen = append(seen, ctx.Value(episodeKey{}).(int))
+		if _, ok := ctx.Deadline(); !ok {
+			t.Errorf("Context passed to fn was supposed to have a deadline set by Timeout")
+		}
+		switch len(seen) {
+		case 1, 3:
+			return ErrRestart{errors.New("start over")}
+		case 2:
+			return ErrRetry{errors.New("do it again")}
+		case 4:
+			// The original context is no longer observed
+			cancel()
+			return ErrRetry{errors.New("do it again")}
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("Do was supposed to return successfully, returned %v", err)
+	}
+	if expected := []int{0, 1, 1, 2, 2}; !slices.Equal(seen, expected) {
+		t.Errorf("fn was supposed to receive contexts of episodes %v, got %v", expected, seen)
+	}
+}
+
+func TestContextFactoryDeadline(t *testing.T) {
+	// The deadline of the original context does not bound the fresh one
+	ctx, cancel := context.WithTimeout(context.Background(), time.Hour)
+	defer cancel()
+
+	var fnCalled int
+	err := Do(ctx, Config{Delay: time.Nanosecond, ContextFactory: context.Background}, func(ctx context.Context) error {
+		fnCalled++
+		if fnCalled == 1 {
+			return ErrRestart{errors.New("start over")}
+		}
+		if deadline, ok := ctx.Deadline(); ok {
+			t.Errorf("Fresh context was not supposed to have a deadline, got %v", deadline)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("Do was supposed to return successfully, returned %v", err)
+	}
+}
+
+type traceIDKey struct{}
+
+func TestLogContextAttrs(t *testing.T) {
+	h := &recordingHandler{}
+	cfg := Config{
+		Delay:  time.Nanosecond,
+		Logger: slog.New(h),
+		Name:   "op",
+		LogContextAttrs: func(ctx context.Context) []slog.Attr {
+			return []slog.Attr{slog.Any("trace_id", ctx.Value(traceIDKey{}))}
+		},
+		SlowAttemptThreshold: time.Nanosecond,
+		now: func() func() time.Time {
+			var now time.Time
+			return func() time.Time {
+				now = now.Add(time.Second)
+				return now
+			}
+		}(),
+	}
+
+	ctx := context.WithValue(context.Background(), traceIDKey{}, "abc")
+	var fnCalled int
+	err := Do(ctx, cfg, func(ctx context.Context) error {
+		fnCalled++
+		if fnCalled == 2 {
+			return nil
+		}
+		return ErrRetry{errors.New("do it again")}
+	})
+	if err != nil {
+		t.Fatalf("Do was supposed to return successfully, returned %v", err)
+	}
+
+	if len(h.records) != 3 {
+		t.Fatalf("Two slow attempts and a retry were supposed to be logged, got %d records", len(h.records))
+	}
+	for _, r := range h.records {
+		var attrs []string
+		r.Attrs(func(a slog.Attr) bool {
+			attrs = append(attrs, a.String())
+			return true
+		})
+		if len(attrs) < 2 || attrs[0] != "op=op" || attrs[1] != "trace_id=abc" {
+			t.Errorf("Record %q was supposed to start with op and trace_id attributes, got %v", r.Message, attrs)
+		}
+	}
+}
+
+func TestDelayCeilingFunc(t *testing.T) {
+	// Peak hours are 9:00-17:00, with a higher ceiling to back off gently
+	now := time.Date(2024, 1, 1, 16, 59, 30, 0, time.UTC)
+	var delays []time.Duration
+	cfg := Config{
+		Delay:  time.Second,
+		Scale:  2,
+		Jitter: NoJitter,
+		DelayCeilingFunc: func(now time.Time) time.Duration {
+			if h := now.Hour(); h >= 9 && h < 17 {
+				return 8 * time.Second
+			}
+			return 2 * time.Second
+		},
+		timeAfter: func(d time.Duration) <-chan time.Time {
+			delays = append(delays, d)
+			now = now.Add(d)
+			return time.After(0)
+		},
+		now: func() time.Time { return now },
+	}
+
+	var fnCalled int
+	err := Do(context.Background(), cfg, func(ctx context.Context) error {
+		fnCalled++
+		if fnCalled == 8 {
+			return nil
+		}
+		return ErrRetry{errors.New("do it again")}
+	})
+	if err != nil {
+		t.Fatalf("Do was supposed to return successfully, returned %v", err)
+	}
+
+	s := time.Second
+	// Peak until 17:00, then off-peak
+	expected := []time.Duration{s, 2 * s, 4 * s, 8 * s, 8 * s, 8 * s, 2 * s}
+	if !slices.Equal(delays, expected) {
+		t.Errorf("Delays were supposed to be %v, got %v", expected, delays)
+	}
+
+	cfg.DelayCeilingFunc = func(time.Time) time.Duration { return -1 }
+	err = Do(context.Background(), cfg, func(ctx context.Context) error {
+		return ErrRetry{errors.New("do it again")}
+	})
+	if err == nil {
+		t.Errorf("Do was supposed to fail on negative delay ceiling")
+	}
+}
+
+func TestJitterAttempts(t *testing.T) {
+	var delays []time.Duration
+	cfg := Config{
+		Delay:          time.Second,
+		Scale:          2,
+		Jitter:         0.5,
+		JitterAttempts: 3,
+		Rand:           rand.New(rand.NewSource(1)),
+		timeAfter: func(d time.Duration) <-chan time.Time {
+			delays = append(delays, d)
+			return time.After(0)
+		},
+	}
+
+	var fnCalled int
+	err := Do(context.Background(), cfg, func(ctx context.Context) error {
+		fnCalled++
+		if fnCalled == 6 {
+			return nil
+		}
+		return ErrRetry{errors.New("do it again")}
+	})
+	if err != nil {
+		t.Fatalf("Do was supposed to return successfully, returned %v", err)
+	}
+
+	base := []time.Duration{time.Second, 2 * time.Second, 4 * time.Second, 8 * time.Second, 16 * time.Second}
+	for i, d := range delays {
+		jittered := i < 3
+		if (d != base[i]) != jittered {
+			t.Errorf("Delay %d was supposed to be jittered: %v, got %v for base %v", i+1, jittered, d, base[i])
+		}
+	}
+}
+
+func TestCleanTimeoutError(t *testing.T) {
+	cfg := Config{Delay: 100 * time.Hour, Timeout: 10 * time.Millisecond, CleanTimeoutError: true}
+	err := Do(context.Background(), cfg, func(ctx context.Context) error {
+		return ErrRetry{errors.New("do it again")}
+	})
+	if err != ErrTimeout {
+		t.Fatalf("Do was supposed to return %v, returned %v", ErrTimeout, err)
+	}
+	if !errors.Is(err, ErrTimeout) || !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("Error was supposed to match both ErrTimeout and context.DeadlineExceeded")
+	}
+
+	// Deadline of the caller's context is not replaced
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	cfg.Timeout = 0
+	err = Do(ctx, cfg, func(ctx context.Context) error {
+		return ErrRetry{errors.New("do it again")}
+	})
+	if err != context.DeadlineExceeded {
+		t.Errorf("Do was supposed to return %v, returned %v", context.DeadlineExceeded, err)
+	}
+}
+
+func TestDo1Validate(t *testing.T) {
+	var delays []time.Duration
+	cfg := Config{
+		Delay:  time.Second,
+		Scale:  2,
+		Jitter: NoJitter,
+		timeAfter: func(d time.Duration) <-chan time.Time {
+			delays = append(delays, d)
+			return time.After(0)
+		},
+	}
+
+	states := []string{"pending", "pending", "reset", "pending", "ready"}
+	var fnCalled int
+	val, err := Do1Validate(context.Background(), cfg, func(ctx context.Context) (string, error) {
+		fnCalled++
+		return states[fnCalled-1], nil
+	}, func(state string) Decision {
+		switch state {
+		case "pending":
+			return DecisionRetry
+		case "reset":
+			return DecisionRestart
+		default:
+			return DecisionDone
+		}
+	})
+	if err != nil || val != "ready" {
+		t.Fatalf("Do1Validate was supposed to return (ready, nil), returned (%s, %v)", val, err)
+	}
+	if expected := []time.Duration{time.Second, 2 * time.Second, time.Second, 2 * time.Second}; !slices.Equal(delays, expected) {
+		t.Errorf("Delays were supposed to be %v, got %v", expected, delays)
+	}
+
+	errFatal := errors.New("fatal")
+	val, err = Do1Validate(context.Background(), cfg, func(ctx context.Context) (string, error) {
+		return "partial", errFatal
+	}, func(string) Decision {
+		t.Errorf("validate was not supposed to be called on error")
+		return DecisionDone
+	})
+	if err != errFatal || val != "partial" {
+		t.Errorf("Do1Validate was supposed to return (partial, %v), returned (%s, %v)", errFatal, val, err)
+	}
+}
+
+func TestOnScheduled(t *testing.T) {
+	now := time.Unix(1000, 0)
+	type scheduled struct {
+		delay time.Duration
+		at    time.Time
+	}
+	var got []scheduled
+	var delays []time.Duration
+	cfg := Config{
+		Delay:       time.Second,
+		Scale:       2,
+		OnScheduled: func(d time.Duration, at time.Time) { got = append(got, scheduled{d, at}) },
+		timeAfter: func(d time.Duration) <-chan time.Time {
+			delays = append(delays, d)
+			now = now.Add(d)
+			return time.After(0)
+		},
+		now: func() time.Time { return now },
+	}
+
+	var fnCalled int
+	err := Do(context.Background(), cfg, func(ctx context.Context) error {
+		fnCalled++
+		if len(got) > 0 && !now.Equal(got[len(got)-1].at) {
+			t.Errorf("Attempt was supposed to happen at %v, happened at %v", got[len(got)-1].at, now)
+		}
+		now = now.Add(100 * time.Millisecond)
+		if fnCalled == 4 {
+			return nil
+		}
+		return ErrRetry{errors.New("do it again")}
+	})
+	if err != nil {
+		t.Fatalf("Do was supposed to return successfully, returned %v", err)
+	}
+
+	if len(got) != len(delays) {
+		t.Fatalf("OnScheduled was supposed to be called %d times, called %d times", len(delays), len(got))
+	}
+	for i, s := range got {
+		if s.delay != delays[i] {
+			t.Errorf("OnScheduled was supposed to report delay %v, reported %v", delays[i], s.delay)
+		}
+	}
+}
+
+func TestErrStop(t *testing.T) {
+	for _, stop := range []error{
+		ErrStop,
+		fmt.Errorf("job finished: %w", ErrStop),
+		ErrRetry{ErrStop},
+	} {
+		t.Run(stop.Error(), func(t *testing.T) {
+			var fnCalled int
+			val, err := Do1(context.Background(), Config{Delay: time.Nanosecond}, func(ctx context.Context) (int, error) {
+				fnCalled++
+				if fnCalled == 3 {
+					return fnCalled, stop
+				}
+				return fnCalled, ErrRetry{errors.New("still running")}
+			})
+			if err != nil {
+				t.Fatalf("Do1 was supposed to return successfully, returned %v", err)
+			}
+			if val != 3 {
+				t.Errorf("Do1 was supposed to return the last value 3, returned %d", val)
+			}
+		})
+	}
+}
+
+func TestWrap(t *testing.T) {
+	t.Run("invalid config", func(t *testing.T) {
+		defer func() {
+			if recover() == nil {
+				t.Errorf("Wrap was supposed to panic on invalid config")
+			}
+		}()
+		Wrap(Config{}, func(ctx context.Context) error { return nil })
+	})
+
+	t.Run("concurrent calls", func(t *testing.T) {
+		var mu sync.Mutex
+		calls := map[int]int{}
+		get := Wrap1(Config{Delay: time.Nanosecond}, func(ctx context.Context) (int, error) {
+			id := ctx.Value(requestIDKey{}).(int)
+			mu.Lock()
+			calls[id]++
+			n := calls[id]
+			mu.Unlock()
+			if n < 3 {
+				return 0, ErrRetry{errors.New("do it again")}
+			}
+			return id, nil
+		})
+
+		var wg sync.WaitGroup
+		for id := range 10 {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				val, err := get(context.WithValue(context.Background(), requestIDKey{}, id))
+				if err != nil || val != id {
+					t.Errorf("Wrapped function was supposed to return (%d, nil), returned (%d, %v)", id, val, err)
+				}
+			}()
+		}
+		wg.Wait()
+
+		for id := range 10 {
+			if calls[id] != 3 {
+				t.Errorf("fn was supposed to be called %d times for call %d, called %d times", 3, id, calls[id])
+			}
+		}
+	})
+}
+
+func TestOnFirstAttempt(t *testing.T) {
+	t.Run("after pre-delay", func(t *testing.T) {
+		var events []string
+		cfg := Config{
+			Delay:    time.Nanosecond,
+			Jitter:   NoJitter,
+			PreDelay: time.Hour,
+			timeAfter: func(d time.Duration) <-chan time.Time {
+				events = append(events, fmt.Sprintf("wait %v", d))
+				return time.After(0)
+			},
+			OnFirstAttempt: func(ctx context.Context) {
+				events = append(events, "first attempt")
+			},
+		}
+		var fnCalled int
+		err := Do(context.Background(), cfg, func(ctx context.Context) error {
+			fnCalled++
+			events = append(events, "fn")
+			if fnCalled < 2 {
+				return ErrRetry{errors.New("do it again")}
+			}
+			return nil
+		})
+		if err != nil {
+			t.Fatalf("Do was supposed to return successfully, returned %v", err)
+		}
+		expected := []string{"wait 1h0m0s", "first attempt", "fn", "wait 1ns", "fn"}
+		if !slices.Equal(events, expected) {
+			t.Errorf("Events were supposed to be %v, got %v", expected, events)
+		}
+	})
+
+	t.Run("cancelled in pre-delay", func(t *testing.T) {
+		ctx, cancel := context.WithCancel(context.Background())
+		cfg := Config{
+			Delay:    time.Nanosecond,
+			PreDelay: time.Hour,
+			timeAfter: func(d time.Duration) <-chan time.Time {
+				cancel()
+				return nil
+			},
+			OnFirstAttempt: func(ctx context.Context) {
+				t.Errorf("OnFirstAttempt was not supposed to be called")
+			},
+		}
+		err := Do(ctx, cfg, func(ctx context.Context) error {
+			t.Errorf("fn was not supposed to be called")
+			return nil
+		})
+		if err != context.Canceled {
+			t.Errorf("Do was supposed to return %v, returned %v", context.Canceled, err)
+		}
+	})
+}
+
+func TestStrictValidate(t *testing.T) {
+	s := time.Second
+	if err := (Config{Delay: 2 * s, MaxDelay: s}).Validate(); err != nil {
+		t.Errorf("Validate was supposed to accept max delay below delay, returned %v", err)
+	}
+	if err := (Config{Delay: 2 * s, MaxDelay: s, StrictValidate: true}).Validate(); err == nil {
+		t.Errorf("Validate was supposed to reject max delay below delay under StrictValidate")
+	}
+
+	for _, tc := range []struct {
+		cfg    Config
+		logged bool
+	}{
+		{Config{Delay: time.Nanosecond, MaxDelay: time.Nanosecond, Scale: 2, StrictValidate: true}, true},
+		{Config{Delay: time.Nanosecond, MaxDelay: time.Nanosecond, Scale: 2}, false},
+		{Config{Delay: time.Nanosecond, MaxDelay: time.Nanosecond, StrictValidate: true}, false},
+		{Config{Delay: time.Nanosecond, MaxDelay: time.Microsecond, Scale: 2, StrictValidate: true}, false},
+	} {
+		h := &recordingHandler{}
+		tc.cfg.Logger = slog.New(h)
+		if err := Do(context.Background(), tc.cfg, func(ctx context.Context) error { return nil }); err != nil {
+			t.Fatalf("Do was supposed to return successfully, returned %v", err)
+		}
+		logged := len(h.records) == 1 && h.records[0].Level == slog.LevelDebug
+		if logged != tc.logged || len(h.records) > 1 {
+			t.Errorf("No-op scaling was supposed to be logged: %v, got records %v", tc.logged, h.records)
+		}
+	}
+}
+
+func TestDo1Fold(t *testing.T) {
+	var prevs []int
+	val, err := Do1Fold(context.Background(), Config{Delay: time.Nanosecond}, 10, func(ctx context.Context, prev int) (int, error) {
+		prevs = append(prevs, prev)
+		switch len(prevs) {
+		case 1:
+			return prev + 1, ErrRetry{errors.New("partial progress")}
+		case 2:
+			return prev + 2, ErrRestart{errors.New("partial progress")}
+		default:
+			return prev + 3, nil
+		}
+	})
+	if err != nil {
+		t.Fatalf("Do1Fold was supposed to return successfully, returned %v", err)
+	}
+	if val != 16 {
+		t.Errorf("Do1Fold was supposed to return %d, returned %d", 16, val)
+	}
+	expected := []int{10, 11, 13}
+	if !slices.Equal(prevs, expected) {
+		t.Errorf("fn was supposed to receive %v, got %v", expected, prevs)
+	}
+}
+
+func TestZeroDelay(t *testing.T) {
+	var delays []time.Duration
+	cfg := Config{
+		AllowZeroDelay:   true,
+		Scale:            2,
+		MaxTotalAttempts: 5,
+		timeAfter: func(d time.Duration) <-chan time.Time {
+			delays = append(delays, d)
+			return time.After(d)
+		},
+	}
+	var fnCalled int
+	err := Do(context.Background(), cfg, func(ctx context.Context) error {
+		fnCalled++
+		return ErrRetry{errors.New("do it again")}
+	})
+	if !errors.Is(err, ErrTotalAttemptsExhausted) {
+		t.Errorf("Do was supposed to return %v, returned %v", ErrTotalAttemptsExhausted, err)
+	}
+	if fnCalled != 5 {
+		t.Errorf("fn was supposed to be called %d times, called %d times", 5, fnCalled)
+	}
+	expected := []time.Duration{0, 0, 0, 0}
+	if !slices.Equal(delays, expected) {
+		t.Errorf("Delays were supposed to be %v, got %v", expected, delays)
+	}
+}
+
+func TestWaitFor(t *testing.T) {
+	t.Run("gates attempts", func(t *testing.T) {
+		var events []string
+		cfg := Config{
+			Delay: time.Nanosecond,
+			WaitFor: func(ctx context.Context) error {
+				events = append(events, "wait")
+				return nil
+			},
+		}
+		var fnCalled int
+		err := Do(context.Background(), cfg, func(ctx context.Context) error {
+			fnCalled++
+			events = append(events, "fn")
+			if fnCalled < 2 {
+				return ErrRetry{errors.New("do it again")}
+			}
+			return nil
+		})
+		if err != nil {
+			t.Fatalf("Do was supposed to return successfully, returned %v", err)
+		}
+		expected := []string{"wait", "fn", "wait", "fn"}
+		if !slices.Equal(events, expected) {
+			t.Errorf("Events were supposed to be %v, got %v", expected, events)
+		}
+	})
+
+	t.Run("error", func(t *testing.T) {
+		notReady := errors.New("not ready")
+		cfg := Config{
+			Delay:   time.Nanosecond,
+			WaitFor: func(ctx context.Context) error { return notReady },
+		}
+		err := Do(context.Background(), cfg, func(ctx context.Context) error {
+			t.Errorf("fn was not supposed to be called")
+			return nil
+		})
+		if err != notReady {
+			t.Errorf("Do was supposed to return %v, returned %v", notReady, err)
+		}
+	})
+
+	t.Run("cancelled", func(t *testing.T) {
+		ctx, cancel := context.WithCancel(context.Background())
+		var reason GiveUpReason
+		cfg := Config{
+			Delay: time.Nanosecond,
+			WaitFor: func(ctx context.Context) error {
+				cancel()
+				<-ctx.Done()
+				return ctx.Err()
+			},
+			OnGiveUp: func(r GiveUpReason, err error, attempts int) { reason = r },
+		}
+		err := Do(ctx, cfg, func(ctx context.Context) error {
+			t.Errorf("fn was not supposed to be called")
+			return nil
+		})
+		if err != context.Canceled {
+			t.Errorf("Do was supposed to return %v, returned %v", context.Canceled, err)
+		}
+		if reason != GiveUpContextCancelled {
+			t.Errorf("Give up reason was supposed to be %v, got %v", GiveUpContextCancelled, reason)
+		}
+	})
+}
+
+func TestGroup(t *testing.T) {
+	var group Group
+	release := make(chan struct{})
+	var mu sync.Mutex
+	var fnCalled int
+	calls := func() int {
+		mu.Lock()
+		defer mu.Unlock()
+		return fnCalled
+	}
+	fn := func(ctx context.Context) error {
+		mu.Lock()
+		fnCalled++
+		n := fnCalled
+		mu.Unlock()
+		if n == 1 {
+			<-release
+		}
+		if n < 3 {
+			return ErrRetry{errors.New("do it again")}
+		}
+		return nil
+	}
+
+	var wg sync.WaitGroup
+	for range 10 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := Do(context.Background(), Config{Delay: time.Nanosecond, Name: "op", Group: &group}, fn); err != nil {
+				t.Errorf("Do was supposed to return successfully, returned %v", err)
+			}
+		}()
+	}
+	for group.waiting("op") < 9 { // all calls but the running one
+		runtime.Gosched()
+	}
+	close(release)
+	wg.Wait()
+
+	if n := calls(); n != 3 {
+		t.Errorf("fn was supposed to be called %d times, called %d times", 3, n)
+	}
+
+	// The group only holds retries in progress
+	if err := Do(context.Background(), Config{Delay: time.Nanosecond, Name: "op", Group: &group}, fn); err != nil {
+		t.Errorf("Do was supposed to return successfully, returned %v", err)
+	}
+	if n := calls(); n != 4 {
+		t.Errorf("fn was supposed to be called %d times, called %d times", 4, n)
+	}
+}
+
+func TestSpreadConfig(t *testing.T) {
+	for _, tc := range []struct {
+		attempts int
+		total    time.Duration
+		jitter   float64
+	}{
+		{2, time.Second, 0},
+		{5, 10 * time.Second, 0},
+		{10, time.Minute, 0.25},
+		{20, time.Hour, 0.5},
+		{50, time.Second, 0},
+		{64, time.Minute, 0},
+		{1000, time.Second, 0},
+		{1000, time.Hour, 0.5},
+	} {
+		t.Run(fmt.Sprint(tc), func(t *testing.T) {
+			var sum time.Duration
+			cfg := SpreadConfig(tc.attempts, tc.total, tc.jitter)
+			cfg.Rand = rand.New(rand.NewSource(1))
+			cfg.timeAfter = func(d time.Duration) <-chan time.Time {
+				sum += d
+				return time.After(0)
+			}
+			var fnCalled int
+			err := Do(context.Background(), cfg, func(ctx context.Context) error {
+				fnCalled++
+				return ErrRetry{errors.New("do it again")}
+			})
+			if !errors.Is(err, ErrTotalAttemptsExhausted) {
+				t.Errorf("Do was supposed to return %v, returned %v", ErrTotalAttemptsExhausted, err)
+			}
+			if fnCalled != tc.attempts {
+				t.Errorf("fn was supposed to be called %d times, called %d times", tc.attempts, fnCalled)
+			}
+			if diff := math.Abs(float64(sum-tc.total)) / float64(tc.total); diff > tc.jitter+0.001 {
+				t.Errorf("Delays were supposed to sum up to about %v, got %v", tc.total, sum)
+			}
+		})
+	}
+
+	if err := SpreadConfig(0, time.Second, 0).Validate(); err == nil {
+		t.Errorf("SpreadConfig was supposed to return an invalid config for no attempts")
+	}
+}
+
+func TestGroupWaiter(t *testing.T) {
+	t.Run("context done", func(t *testing.T) {
+		var group Group
+		started := make(chan struct{})
+		release := make(chan struct{})
+		defer close(release)
+		go func() {
+			_ = Do(context.Background(), Config{Delay: time.Nanosecond, Name: "op", Group: &group}, func(ctx context.Context) error {
+				close(started)
+				<-release
+				return nil
+			})
+		}()
+		<-started
+
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+		err := Do(ctx, Config{Delay: time.Nanosecond, Name: "op", Group: &group}, func(ctx context.Context) error {
+			t.Errorf("fn was not supposed to be called")
+			return nil
+		})
+		if err != context.Canceled {
+			t.Errorf("Do was supposed to return %v, returned %v", context.Canceled, err)
+		}
+	})
+
+	t.Run("panic", func(t *testing.T) {
+		var group Group
+		started := make(chan struct{})
+		release := make(chan struct{})
+		go func() {
+			defer func() { _ = recover() }()
+			_ = Do(context.Background(), Config{Delay: time.Nanosecond, Name: "op", Group: &group}, func(ctx context.Context) error {
+				close(started)
+				<-release
+				panic("fn failed")
+			})
+		}()
+		<-started
+
+		waiterErr := make(chan error)
+		go func() {
+			waiterErr <- Do(context.Background(), Config{Delay: time.Nanosecond, Name: "op", Group: &group}, func(ctx context.Context) error {
+				return nil
+			})
+		}()
+		for group.waiting("op") < 1 {
+			runtime.Gosched()
+		}
+		close(release)
+		if err := <-waiterErr; err != ErrGroupPanic {
+			t.Errorf("Do was supposed to return %v, returned %v", ErrGroupPanic, err)
+		}
+	})
+}
@@ -0,0 +1,102 @@
+package retry
+
+import (
+	"fmt"
+	"time"
+)
+
+// BackoffPhase is one phase of Config.BackoffSchedule
+type BackoffPhase struct {
+	// Delay is a delay between attempts at the start of the phase.
+	//
+	// This field is required.
+	Delay time.Duration
+
+	// Scale is a exponential scale for delay within the phase.
+	//
+	// Defaults to 1 (no scaling, constant delay), can't be less than 1.
+	Scale float64
+
+	// Attempts is a number of retries after which the next phase starts.
+	Attempts int
+
+	// Duration is a time after which the next phase starts, counted from
+	// the start of the phase.
+	//
+	// A phase ends once either Attempts or Duration is reached. All phases
+	// except the last one need at least one of them. The last phase
+	// continues indefinitely.
+	Duration time.Duration
+}
+
+func validateSchedule(schedule []BackoffPhase) error {
+	if len(schedule) == 0 {
+		return fmt.Errorf("backoff schedule is empty")
+	}
+	for i, phase := range schedule {
+		if phase.Delay <= 0 {
+			return fmt.Errorf("backoff phase %d: no delay is specified", i)
+		}
+		if phase.Scale != 0 && phase.Scale < 1 {
+			return fmt.Errorf("backoff phase %d: scale can't be less than 1", i)
+		}
+		if phase.Attempts < 0 || phase.Duration < 0 {
+			return fmt.Errorf("backoff phase %d: extent can't be negative", i)
+		}
+		if i < len(schedule)-1 && phase.Attempts == 0 && phase.Duration == 0 {
+			return fmt.Errorf("backoff phase %d: no extent is specified", i)
+		}
+	}
+	return nil
+}
+
+// backoff computes delays between attempts, before jitter is applied
+type backoff struct {
+	phases []BackoffPhase
+	now    func() time.Time
+	// capPhaseStart caps the first delay of each phase by maxDelay too,
+	// as a schedule may start a phase with a delay above MaxDelay
+	capPhaseStart bool
+
+	phase      int
+	retries    int
+	phaseStart time.Time
+	delay      time.Duration
+}
+
+func (b *backoff) startPhase(phase int) {
+	b.phase = phase
+	b.retries = 0
+	b.phaseStart = b.now()
+	b.delay = b.phases[phase].Delay
+}
+
+// reset starts the schedule from the beginning
+func (b *backoff) reset() {
+	b.startPhase(0)
+}
+
+// next returns the delay before the next attempt and advances the schedule
+//
+// Scaled delays are capped by maxDelay. The first delay of a phase is only
+// capped if capPhaseStart is set.
+func (b *backoff) next(maxDelay time.Duration) time.Duration {
+	p := b.phases[b.phase]
+	if b.phase < len(b.phases)-1 &&
+		(p.Attempts > 0 && b.retries >= p.Attempts || p.Duration > 0 && b.now().Sub(b.phaseStart) >= p.Duration) {
+		b.startPhase(b.phase + 1)
+		p = b.phases[b.phase]
+	}
+
+	delay := b.delay
+	if b.capPhaseStart {
+		delay = min(delay, maxDelay)
+	}
+	b.retries++
+
+	b.delay = time.Duration(float64(b.delay) * p.Scale)
+	if b.delay > maxDelay {
+		b.delay = maxDelay
+	}
+	return delay
+}
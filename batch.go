@@ -0,0 +1,81 @@
+package retry
+
+import (
+	"context"
+	"errors"
+)
+
+// DoBatch runs fn for each item, retrying failed items in rounds controlled
+// by config
+//
+// Each round calls fn for every item that is still pending. Items for which
+// fn returns ErrRetry are retried in the next round, after the delay. If fn
+// returns ErrRestart for any item, the retries are restarted as in Do. Items
+// for which fn returns any other error fail permanently and are not retried.
+// Errors of each item are classified as in Do, so ErrStop, RetryOn, StopOn
+// and RetryOnCtxError apply to them.
+//
+// DoBatch returns the items that failed permanently or were still pending
+// when the retries ended, in their original order. The returned error joins
+// the errors of permanently failed items and the error that ended the
+// retries, if any.
+func DoBatch[T any](ctx context.Context, cfg Config, items []T, fn func(ctx context.Context, item T) error) ([]T, error) {
+	pending := make([]int, len(items))
+	for i := range items {
+		pending[i] = i
+	}
+	failed := make([]bool, len(items))
+	var errs []error
+
+	err := Do(ctx, cfg, func(ctx context.Context) error {
+		var retry []int
+		var retryErrs []error
+		var restart bool
+		for _, i := range pending {
+			err, doRetry, doRestart, stopped := classifyAttempt(ctx, &cfg, fn(ctx, items[i]))
+			if err == nil {
+				continue
+			}
+
+			switch {
+			case stopped:
+				failed[i] = true
+				errs = append(errs, cause(err))
+				continue
+			case doRestart:
+				restart = true
+			case doRetry:
+			default:
+				failed[i] = true
+				errs = append(errs, err)
+				continue
+			}
+			retry = append(retry, i)
+			retryErrs = append(retryErrs, err)
+		}
+
+		pending = retry
+		switch {
+		case restart:
+			return ErrRestart{errors.Join(retryErrs...)}
+		case len(pending) > 0:
+			return ErrRetry{errors.Join(retryErrs...)}
+		default:
+			return nil
+		}
+	})
+	if err != nil {
+		errs = append(errs, err)
+		for _, i := range pending {
+			failed[i] = true
+		}
+	}
+
+	var out []T
+	for i, item := range items {
+		if failed[i] {
+			out = append(out, item)
+		}
+	}
+	return out, errors.Join(errs...)
+}
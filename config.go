@@ -0,0 +1,265 @@
+package retry
+
+import (
+	"fmt"
+	"log/slog"
+	"math"
+	"reflect"
+	"slices"
+	"time"
+)
+
+// Validate checks the config for errors
+//
+// Do validates the config on each call, Validate allows reporting an
+// invalid config early, e.g. when it is loaded.
+func (cfg Config) Validate() error {
+	if cfg.BackoffSchedule != nil {
+		if err := validateSchedule(cfg.BackoffSchedule); err != nil {
+			return err
+		}
+	} else if cfg.NextDelay == nil {
+		if cfg.Delay == 0 && !cfg.AllowZeroDelay {
+			return fmt.Errorf("no delay is specified")
+		}
+		if cfg.Delay == 0 && cfg.MaxTotalAttempts == 0 && cfg.Timeout == 0 {
+			return fmt.Errorf("zero delay requires max total attempts or timeout")
+		}
+		if cfg.Scale != 0 && cfg.Scale < 1 {
+			return fmt.Errorf("scale can't be less than 1")
+		}
+	}
+
+	if cfg.StrictValidate && cfg.MaxDelay > 0 && cfg.MaxDelay < cfg.Delay {
+		return fmt.Errorf("max delay can't be less than delay")
+	}
+
+	if cfg.FirstDelay < 0 {
+		return fmt.Errorf("first delay can't be negative")
+	}
+	if cfg.MaxDelay != 0 && cfg.FirstDelay > cfg.MaxDelay {
+		return fmt.Errorf("first delay can't exceed max delay")
+	}
+
+	if cfg.Jitter != NoJitter && (cfg.Jitter < 0 || cfg.Jitter > 1) {
+		return fmt.Errorf("jitter has to be within [0,1]")
+	}
+
+	jitter := cfg.Jitter
+	switch jitter {
+	case NoJitter:
+		jitter = 0
+	case 0:
+		jitter = defaultJitter
+	}
+	if cfg.JitterFloorFraction < 0 || cfg.JitterFloorFraction > jitter {
+		return fmt.Errorf("jitter floor has to be within [0,jitter]")
+	}
+
+	if cfg.JitterAttempts < 0 {
+		return fmt.Errorf("jitter attempts can't be negative")
+	}
+
+	if cfg.MaxJitterAbsolute < 0 {
+		return fmt.Errorf("max absolute jitter can't be negative")
+	}
+
+	if cfg.StopAtMaxDelay && cfg.MaxDelay == 0 && cfg.MaxDelayFunc == nil && cfg.DelayCeilingFunc == nil {
+		return fmt.Errorf("stopping at max delay requires max delay")
+	}
+	if cfg.MaxDelayStreak < 0 {
+		return fmt.Errorf("max delay streak can't be negative")
+	}
+
+	if cfg.MaxTotalAttempts < 0 {
+		return fmt.Errorf("max total attempts can't be negative")
+	}
+
+	if cfg.MaxConsecutiveSameError < 0 {
+		return fmt.Errorf("max consecutive same error can't be negative")
+	}
+
+	if cfg.MaxDelayJitter < 0 {
+		return fmt.Errorf("max delay jitter can't be negative")
+	}
+
+	if cfg.LogSampleEvery < 0 {
+		return fmt.Errorf("log sampling rate can't be negative")
+	}
+
+	if cfg.Group != nil && cfg.Name == "" {
+		return fmt.Errorf("group requires name")
+	}
+
+	if cfg.Heartbeat.Fn != nil && cfg.Heartbeat.Interval <= 0 {
+		return fmt.Errorf("heartbeat interval has to be positive")
+	}
+
+	return nil
+}
+
+// Merge returns base with the fields set in override replacing the
+// corresponding fields of base
+//
+// A field is set if it is not a zero value, so a field can't be reset to
+// its default by override: e.g. Jitter: 0 keeps the jitter of base (use
+// NoJitter to disable jitter), and false keeps a bool option of base.
+// Slices and structs such as BackoffSchedule and Heartbeat are replaced as
+// a whole.
+func (base Config) Merge(override Config) Config {
+	b := reflect.ValueOf(&base).Elem()
+	o := reflect.ValueOf(override)
+	for i := range o.NumField() {
+		if f := o.Field(i); f.CanInterface() && !f.IsZero() {
+			b.Field(i).Set(f)
+		}
+	}
+
+	// Unexported fields can't be set by reflection
+	if override.timeAfter != nil {
+		base.timeAfter = override.timeAfter
+	}
+	if override.timeoutAfter != nil {
+		base.timeoutAfter = override.timeoutAfter
+	}
+	if override.now != nil {
+		base.now = override.now
+	}
+	return base
+}
+
+const defaultJitter = 0.125
+
+// setDefaults replaces zero values in a validated config by defaults
+func (cfg *Config) setDefaults() {
+	if cfg.Scale == 0 {
+		cfg.Scale = 1
+	}
+
+	if cfg.BackoffSchedule != nil {
+		// Do not modify the caller's slice
+		cfg.BackoffSchedule = slices.Clone(cfg.BackoffSchedule)
+		for i := range cfg.BackoffSchedule {
+			if cfg.BackoffSchedule[i].Scale == 0 {
+				cfg.BackoffSchedule[i].Scale = 1
+			}
+		}
+	}
+
+	switch cfg.Jitter {
+	case NoJitter:
+		cfg.Jitter = 0
+	case 0:
+		cfg.Jitter = defaultJitter
+	}
+
+	if cfg.MaxDelay == 0 {
+		cfg.MaxDelay = 1<<63 - 1 // time.go:maxDuration
+	}
+
+	if cfg.timeAfter == nil {
+		cfg.timeAfter = time.After
+	}
+	if cfg.timeoutAfter == nil {
+		cfg.timeoutAfter = time.After
+	}
+	if cfg.now == nil {
+		cfg.now = time.Now
+	}
+
+	if cfg.Logger == nil {
+		cfg.Logger = slog.Default()
+	}
+	if cfg.LogLevel == 0 {
+		cfg.LogLevel = slog.LevelDebug
+	}
+	if cfg.FirstErrorLogLevel == 0 {
+		cfg.FirstErrorLogLevel = cfg.LogLevel
+	}
+	if cfg.LogDedupKey == nil {
+		cfg.LogDedupKey = errorString
+	}
+}
+
+// FromBackoffParams returns a config equivalent to github.com/cenkalti/backoff
+// exponential backoff parameters
+//
+// The parameters map as follows:
+//
+//	InitialInterval     -> Delay
+//	RandomizationFactor -> Jitter (0 -> NoJitter)
+//	Multiplier          -> Scale
+//	MaxInterval         -> MaxDelay
+//	MaxElapsedTime      -> Timeout
+func FromBackoffParams(initial time.Duration, randFactor, multiplier float64, maxInterval, maxElapsed time.Duration) Config {
+	jitter := randFactor
+	if jitter == 0 {
+		jitter = NoJitter
+	}
+	return Config{
+		Delay:    initial,
+		Jitter:   jitter,
+		Scale:    multiplier,
+		MaxDelay: maxInterval,
+		Timeout:  maxElapsed,
+	}
+}
+
+// SpreadConfig returns a config making about attempts attempts spread over
+// total time
+//
+// The delays double after each attempt, and the attempts-1 delays sum up to
+// total without jitter. If doubling would make the first delay shorter than
+// 1ms, the delays grow slower, so that the first one is 1ms, or are
+// constant if even that does not fit. Jitter keeps the mean of each delay,
+// so with jitter the sum is only close to total. The time taken by the
+// attempts themselves is not accounted for, so retries take somewhat longer
+// than total. MaxTotalAttempts is set to attempts and MaxDelay to total;
+// Timeout is not set. Jitter 0 disables jitter.
+//
+// SpreadConfig returns an invalid config if attempts is less than 1 or total
+// is not positive.
+func SpreadConfig(attempts int, total time.Duration, jitter float64) Config {
+	if attempts < 1 || total <= 0 {
+		return Config{}
+	}
+	if jitter == 0 {
+		jitter = NoJitter
+	}
+
+	// Delays form a geometric series: first * (scale^n - 1) / (scale - 1) = total
+	n := float64(attempts - 1)
+	first := func(scale float64) float64 {
+		if scale == 1 {
+			return float64(total) / n
+		}
+		return float64(total) * (scale - 1) / (math.Pow(scale, n) - 1)
+	}
+	const minFirstDelay = float64(time.Millisecond)
+	scale := 2.0
+	switch {
+	case attempts == 1:
+		return Config{Delay: total, Jitter: jitter, MaxDelay: total, MaxTotalAttempts: 1}
+	case first(1) <= minFirstDelay:
+		scale = 1
+	case first(2) < minFirstDelay:
+		// first decreases as scale grows, find the scale giving minFirstDelay
+		low, high := 1.0, 2.0
+		for range 64 {
+			scale = (low + high) / 2
+			if first(scale) < minFirstDelay {
+				high = scale
+			} else {
+				low = scale
+			}
+		}
+		scale = low
+	}
+	return Config{
+		Delay:            time.Duration(first(scale)),
+		Scale:            scale,
+		Jitter:           jitter,
+		MaxDelay:         total,
+		MaxTotalAttempts: attempts,
+	}
+}
@@ -0,0 +1,50 @@
+package retry
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+)
+
+var (
+	defaultMu  sync.RWMutex
+	defaultCfg = Config{Delay: time.Second}
+)
+
+// Default returns the application-wide default config used by DoDefault
+//
+// Initially it is Config{Delay: time.Second}.
+func Default() Config {
+	defaultMu.RLock()
+	defer defaultMu.RUnlock()
+	return defaultCfg
+}
+
+// SetDefault sets the application-wide default config used by DoDefault
+//
+// Invalid configs are rejected. SetDefault is safe to call concurrently with
+// Default and DoDefault, though it is typically called once during startup.
+// The config is copied, but the slices and functions it refers to are
+// shared, so they must not be modified afterwards.
+//
+// Configs with Rand set are rejected too: DoDefault may be called
+// concurrently, and *rand.Rand is not safe for concurrent use. Use
+// SeedFromContext for reproducible jitter instead.
+func SetDefault(cfg Config) error {
+	if err := cfg.Validate(); err != nil {
+		return err
+	}
+	if cfg.Rand != nil {
+		return fmt.Errorf("default config can't have Rand, as it is not safe for concurrent use")
+	}
+	defaultMu.Lock()
+	defer defaultMu.Unlock()
+	defaultCfg = cfg
+	return nil
+}
+
+// DoDefault is a version of Do that uses the config set by SetDefault
+func DoDefault(ctx context.Context, fn func(ctx context.Context) error) error {
+	return Do(ctx, Default(), fn)
+}
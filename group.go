@@ -0,0 +1,76 @@
+package retry
+
+import (
+	"context"
+	"errors"
+	"sync"
+)
+
+// Group collapses concurrent retries of the same operation into one
+//
+// Do with Config.Group set runs at most one retry per Config.Name in the
+// group at a time. Calls made while it runs wait for it and return its
+// result instead of retrying on their own, so N goroutines don't hammer
+// the same failing dependency independently.
+//
+// The zero value is ready to use. A Group must not be copied after first
+// use.
+type Group struct {
+	mu    sync.Mutex
+	calls map[string]*groupCall
+}
+
+// ErrGroupPanic is returned to the calls waiting for a shared retry in a
+// Group if fn panics in the call running it
+var ErrGroupPanic = errors.New("shared retry panicked")
+
+// groupCall is a retry in progress
+type groupCall struct {
+	done    chan struct{}
+	err     error
+	waiters int // calls waiting for this one, for tests
+}
+
+// do calls fn, unless a call with the same key is in progress, in which case
+// it waits for that call and returns its result, or the error of ctx if ctx
+// is done first
+func (g *Group) do(ctx context.Context, key string, fn func() error) error {
+	g.mu.Lock()
+	if c, ok := g.calls[key]; ok {
+		c.waiters++
+		g.mu.Unlock()
+		select {
+		case <-c.done:
+			return c.err
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+	c := &groupCall{done: make(chan struct{})}
+	if g.calls == nil {
+		g.calls = map[string]*groupCall{}
+	}
+	g.calls[key] = c
+	g.mu.Unlock()
+
+	defer func() {
+		g.mu.Lock()
+		delete(g.calls, key)
+		g.mu.Unlock()
+		close(c.done)
+	}()
+	c.err = ErrGroupPanic // kept if fn panics
+	c.err = fn()
+	return c.err
+}
+
+// waiting returns the number of calls that joined the call with key in
+// progress, for tests
+func (g *Group) waiting(key string) int {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if c, ok := g.calls[key]; ok {
+		return c.waiters
+	}
+	return 0
+}
@@ -0,0 +1,169 @@
+package retry
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"time"
+)
+
+// retryLogger logs retriable errors, omitting identical subsequent ones
+type retryLogger struct {
+	logger     *slog.Logger
+	level      slog.Level
+	firstLevel slog.Level // level of the first error
+	name       string
+
+	// dedupKey returns a key used to detect identical subsequent errors
+	dedupKey func(error) string
+	// sampleEvery is a sampling rate of errors that are not duplicates
+	sampleEvery int
+	// contextAttrs extracts attributes to log from the context
+	contextAttrs func(ctx context.Context) []slog.Attr
+	// transitionsOnly replaces logging of each error by logging of the
+	// first failure and the recovery
+	transitionsOnly bool
+
+	lastKey  string
+	lastLoud bool
+	logged   bool
+	failed   bool
+	distinct int // number of errors that are not duplicates
+}
+
+// reset forgets the last logged error, so the next one is always logged,
+// and logged as the first one
+func (l *retryLogger) reset() {
+	l.lastKey = ""
+	l.logged = false
+	l.failed = false
+	l.distinct = 0
+}
+
+func (l *retryLogger) log(ctx context.Context, msg string, err error) {
+	if l.transitionsOnly {
+		return
+	}
+
+	level := l.level
+	if !l.failed {
+		level = l.firstLevel
+		l.failed = true
+	}
+	loud := isLoud(err)
+	if loud {
+		level = slog.LevelError
+	}
+
+	// Check the level first to avoid formatting the error and building
+	// attributes for records that are going to be discarded
+	if !l.logger.Enabled(ctx, level) {
+		return
+	}
+
+	key := l.dedupKey(err)
+	if l.logged && key == l.lastKey && loud == l.lastLoud {
+		return
+	}
+	l.lastKey = key
+	l.lastLoud = loud
+
+	l.distinct++
+	if l.sampleEvery > 1 && l.distinct > 1 && l.distinct%l.sampleEvery != 0 {
+		return
+	}
+	l.logged = true
+
+	attrs := l.baseAttrs(ctx, 2)
+	attrs = append(attrs, slog.Any("error", err))
+	if rootErr := rootCause(err); rootErr.Error() != err.Error() {
+		attrs = append(attrs, slog.String("root_cause", rootErr.Error()))
+	}
+	l.logger.LogAttrs(ctx, level, msg, attrs...)
+}
+
+// logSlowAttempt warns about an attempt that took longer than expected
+func (l *retryLogger) logSlowAttempt(ctx context.Context, dur time.Duration) {
+	if !l.logger.Enabled(ctx, slog.LevelWarn) {
+		return
+	}
+
+	attrs := l.baseAttrs(ctx, 1)
+	attrs = append(attrs, slog.Duration("duration", dur))
+	l.logger.LogAttrs(ctx, slog.LevelWarn, "slow attempt", attrs...)
+}
+
+// logNoScaling notes that Scale has no effect as MaxDelay equals Delay
+func (l *retryLogger) logNoScaling(ctx context.Context) {
+	if !l.logger.Enabled(ctx, slog.LevelDebug) {
+		return
+	}
+
+	attrs := l.baseAttrs(ctx, 0)
+	l.logger.LogAttrs(ctx, slog.LevelDebug, "max delay equals delay, scaling has no effect", attrs...)
+}
+
+// logEntering logs the first failure, if only transitions are logged
+func (l *retryLogger) logEntering(ctx context.Context, err error) {
+	if !l.transitionsOnly || !l.logger.Enabled(ctx, l.firstLevel) {
+		return
+	}
+
+	attrs := l.baseAttrs(ctx, 1)
+	attrs = append(attrs, slog.Any("error", err))
+	l.logger.LogAttrs(ctx, l.firstLevel, "entering retry", attrs...)
+}
+
+// logRecovered logs the success after failures, if only transitions are
+// logged
+func (l *retryLogger) logRecovered(ctx context.Context, attempts int) {
+	if !l.transitionsOnly || !l.logger.Enabled(ctx, l.level) {
+		return
+	}
+
+	attrs := l.baseAttrs(ctx, 1)
+	attrs = append(attrs, slog.Int("attempts", attempts))
+	l.logger.LogAttrs(ctx, l.level, "recovered", attrs...)
+}
+
+// logGiveUp logs the error returned by Do when it gives up
+func (l *retryLogger) logGiveUp(ctx context.Context, reason GiveUpReason, err error) {
+	if !l.logger.Enabled(ctx, l.level) {
+		return
+	}
+
+	attrs := l.baseAttrs(ctx, 2)
+	attrs = append(attrs, slog.Any("error", err), slog.String("reason", reason.String()))
+	l.logger.LogAttrs(ctx, l.level, "giving up", attrs...)
+}
+
+// baseAttrs returns attributes common for all records, with the capacity
+// for n more
+func (l *retryLogger) baseAttrs(ctx context.Context, n int) []slog.Attr {
+	var ctxAttrs []slog.Attr
+	if l.contextAttrs != nil {
+		ctxAttrs = l.contextAttrs(ctx)
+	}
+	attrs := make([]slog.Attr, 0, 1+len(ctxAttrs)+n)
+	if l.name != "" {
+		attrs = append(attrs, slog.String("op", l.name))
+	}
+	return append(attrs, ctxAttrs...)
+}
+
+// rootCause unwraps err as far as possible
+//
+// Errors wrapping multiple errors are not unwrapped further.
+func rootCause(err error) error {
+	for {
+		next := errors.Unwrap(err)
+		if next == nil {
+			return err
+		}
+		err = next
+	}
+}
+
+func errorString(err error) string {
+	return err.Error()
+}
@@ -0,0 +1,37 @@
+package retry
+
+import "time"
+
+// DelayMiddleware modifies the delay before a retry, see
+// Config.DelayMiddlewares
+//
+// attempt is the number of the failed attempt, counted anew after
+// ErrRestart.
+type DelayMiddleware func(attempt int, delay time.Duration) time.Duration
+
+// CapDelay returns a middleware that caps delays at maxDelay
+//
+// Unlike Config.MaxDelay, it caps the final delay, including jitter.
+func CapDelay(maxDelay time.Duration) DelayMiddleware {
+	return func(_ int, delay time.Duration) time.Duration {
+		return min(delay, maxDelay)
+	}
+}
+
+// FloorDelay returns a middleware that keeps delays at least minDelay long
+func FloorDelay(minDelay time.Duration) DelayMiddleware {
+	return func(_ int, delay time.Duration) time.Duration {
+		return max(delay, minDelay)
+	}
+}
+
+// ImmediateFirstRetries returns a middleware that skips the delay for the
+// first n retries
+func ImmediateFirstRetries(n int) DelayMiddleware {
+	return func(attempt int, delay time.Duration) time.Duration {
+		if attempt <= n {
+			return 0
+		}
+		return delay
+	}
+}
@@ -0,0 +1,45 @@
+package retry
+
+import "time"
+
+// Presets are common retry policies. They return new configs, so they can
+// be adjusted directly or with Merge. None of them sets Timeout: the
+// retries are bounded by the context passed to Do, unless Timeout is set.
+
+// Aggressive is a preset for quick operations on local resources that are
+// expected to recover soon
+//
+// Delays start at 10ms and double up to 1s, with ±12.5% jitter.
+func Aggressive() Config {
+	return Config{
+		Delay:    10 * time.Millisecond,
+		Scale:    2,
+		MaxDelay: time.Second,
+	}
+}
+
+// NetworkDefault is a preset for calls to remote services
+//
+// Delays start at 100ms and double up to 30s, with ±50% jitter to keep
+// clients from retrying in lockstep.
+func NetworkDefault() Config {
+	return Config{
+		Delay:    100 * time.Millisecond,
+		Scale:    2,
+		MaxDelay: 30 * time.Second,
+		Jitter:   0.5,
+	}
+}
+
+// Gentle is a preset for background work that should not add load to a
+// struggling dependency
+//
+// Delays start at 1s and double up to 5m, with ±50% jitter.
+func Gentle() Config {
+	return Config{
+		Delay:    time.Second,
+		Scale:    2,
+		MaxDelay: 5 * time.Minute,
+		Jitter:   0.5,
+	}
+}
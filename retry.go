@@ -5,7 +5,10 @@ import (
 	"errors"
 	"fmt"
 	"log/slog"
+	"math"
 	"math/rand"
+	"reflect"
+	"slices"
 	"time"
 )
 
@@ -17,30 +20,245 @@ type Config struct {
 	// Delay is a delay between attempts. It is scaled by Scale for each
 	// consecutive attempt until it reaches MaxDelay
 	//
-	// This field is required.
+	// This field is required, unless BackoffSchedule or NextDelay is set,
+	// or AllowZeroDelay is.
 	Delay time.Duration
 
+	// AllowZeroDelay allows Delay to be zero, retrying immediately without
+	// waiting, e.g. for compare-and-swap loops on in-memory state. Scale and
+	// jitter have no effect on zero delay.
+	//
+	// Zero delay is not allowed by default, as it is more likely a
+	// forgotten Delay. To avoid spinning forever, MaxTotalAttempts or
+	// Timeout has to be set too.
+	//
+	// Defaults to false.
+	AllowZeroDelay bool
+
 	// Scale is a exponential scale for delay.
 	//
 	// Defaults to 1 (no scaling, constant delay), can't be less than 1.
 	Scale float64
 
+	// FirstDelay is a delay before the first retry
+	//
+	// If set, it replaces the first delay, and the following delays start
+	// from Delay (or the first phase of BackoffSchedule), e.g. FirstDelay of
+	// 50ms with Delay of 1s and Scale of 2 gives 50ms, 1s, 2s, 4s... It is
+	// used again after ErrRestart. Unlike PreDelay, it is a delay after the
+	// first failed attempt.
+	//
+	// Defaults to 0 (first delay is Delay), can't be negative or exceed
+	// MaxDelay.
+	FirstDelay time.Duration
+
+	// BackoffSchedule is a sequence of backoff phases, each with its own
+	// delay and scale, e.g. constant delay for a few attempts followed by
+	// exponential backoff.
+	//
+	// If set, it replaces Delay and Scale. MaxDelay caps delays in all phases.
+	// ErrRestart starts the schedule from the first phase.
+	//
+	// Defaults to nil (single phase described by Delay and Scale).
+	BackoffSchedule []BackoffPhase
+
 	// Jitter is the amount of jitter to add to the delay.
 	//
 	// Defaults to 0.125 (12.5%), and has to be within [0,1].
 	// To disable jitter, set this field to NoJitter.
 	Jitter float64
 
+	// JitterAttempts is a number of attempts after which jitter is no longer
+	// applied
+	//
+	// This de-synchronizes clients starting at the same time, and keeps the
+	// following delays predictable. It limits Jitter, JitterFloorFraction and
+	// MaxDelayJitter. Attempts are counted from the start, ErrRestart does
+	// not reset the count.
+	//
+	// Defaults to 0 (jitter is applied to all delays), can't be negative.
+	JitterAttempts int
+
+	// JitterFloorFraction is the minimal amount of jitter.
+	//
+	// Delays are spread uniformly within ±Jitter, but never closer than
+	// ±JitterFloorFraction to the base delay, so the delays of clients are
+	// always decorrelated by at least this fraction.
+	//
+	// Defaults to 0 (no minimum), has to be within [0,Jitter].
+	JitterFloorFraction float64
+
+	// MaxJitterAbsolute caps the magnitude of Jitter in absolute terms.
+	//
+	// Proportional jitter grows with the delay, this keeps it within
+	// ±MaxJitterAbsolute for large delays.
+	//
+	// Defaults to 0 (no cap), can't be negative.
+	MaxJitterAbsolute time.Duration
+
+	// ContextFactory returns a context replacing the context passed to Do
+	// on each ErrRestart
+	//
+	// The returned context is used for the rest of the retries, until the
+	// next restart: Timeout is derived from it, cancelling it stops the
+	// retries, and the context passed to Do is no longer observed. This
+	// allows each restart to run under a freshly obtained parent context.
+	//
+	// Defaults to nil (the context passed to Do is used throughout).
+	ContextFactory func() context.Context
+
 	// PreDelay is optional delay before first try.
 	//
 	// Defaults to 0.
 	PreDelay time.Duration
 
+	// PreDelayBestEffort makes Do call fn once if Timeout is reached during
+	// PreDelay, instead of giving up without calling it.
+	//
+	// The pre-delay is cut short by the timeout, and fn is called with a
+	// context that is not cancelled by Timeout, though it is still cancelled
+	// with the context passed to Do. If fn fails, Do gives up as if the
+	// timeout was reached while waiting to retry, unless fn returns
+	// ErrRestart, which resets the timeout.
+	//
+	// Defaults to false.
+	PreDelayBestEffort bool
+
+	// PreDelayCtx cuts PreDelay short once it is done.
+	//
+	// Once this context is done (including when it is done before Do is
+	// called), the pre-delay ends and the first attempt is made. Unlike the
+	// context passed to Do, it does not affect the retries.
+	//
+	// Defaults to nil (pre-delay is only interrupted by the context passed to
+	// Do).
+	PreDelayCtx context.Context
+
 	// MaxDelay is a cap on delay scaling.
 	//
 	// Defaults to no maximum.
 	MaxDelay time.Duration
 
+	// NextDelay computes the delay before each retry
+	//
+	// It is called with the number of the failed attempt, the previous delay
+	// (0 before the first retry), both counted anew after ErrRestart, and
+	// the error returned by fn. If set, it replaces the delay computation
+	// entirely: Delay, Scale, BackoffSchedule, Jitter and the options
+	// modifying them are not used. The returned delay is still capped by
+	// MaxDelay, unless NextDelayUncapped is set. Negative return value is an
+	// error.
+	//
+	// Defaults to nil (delay is computed from other fields).
+	NextDelay func(attempt int, prevDelay time.Duration, err error) time.Duration
+
+	// NextDelayUncapped makes delays returned by NextDelay exempt from
+	// MaxDelay.
+	//
+	// Defaults to false.
+	NextDelayUncapped bool
+
+	// DelayMiddlewares modify the delay before each retry
+	//
+	// They are applied in order to the final delay, after Jitter and other
+	// options have been applied, so each one sees the result of the previous.
+	// Negative results are treated as 0.
+	//
+	// Defaults to nil (delay is not modified).
+	DelayMiddlewares []DelayMiddleware
+
+	// MaxDelayFunc computes a cap on delay scaling for each attempt.
+	//
+	// It is called with the number of the failed attempt and time elapsed
+	// since the start, both counted anew after ErrRestart. A positive return
+	// value overrides MaxDelay, zero falls back to MaxDelay, and a negative
+	// one is an error.
+	//
+	// Defaults to nil (MaxDelay is used).
+	MaxDelayFunc func(attempt int, elapsed time.Duration) time.Duration
+
+	// DelayCeilingFunc computes a cap on delay scaling from the current time,
+	// e.g. to back off more gently during peak hours.
+	//
+	// A positive return value overrides MaxDelay, zero falls back to it, and
+	// a negative one is an error. If MaxDelayFunc is also set, the smaller
+	// of their caps applies.
+	//
+	// Defaults to nil (MaxDelay is used).
+	DelayCeilingFunc func(now time.Time) time.Duration
+
+	// StopAtMaxDelay makes Do give up once the delay has reached MaxDelay
+	//
+	// Do gives up after MaxDelayStreak retries with the delay at MaxDelay,
+	// returning the last error wrapped together with ErrMaxDelayReached.
+	// ErrRestart resets the streak. Requires MaxDelay, MaxDelayFunc or
+	// DelayCeilingFunc.
+	//
+	// Defaults to false.
+	StopAtMaxDelay bool
+
+	// MaxDelayStreak is a number of retries with the delay at MaxDelay made
+	// before giving up, if StopAtMaxDelay is set.
+	//
+	// Defaults to 0 (give up once the delay reaches MaxDelay).
+	MaxDelayStreak int
+
+	// OnDegraded is called once the delay reaches MaxDelay, signalling that
+	// the dependency is degraded
+	//
+	// It is called at most once per call of Do, and once more after each
+	// ErrRestart. Recovery is signalled by Do returning nil. It is not
+	// called if NextDelay is set.
+	//
+	// Defaults to nil (no callback).
+	OnDegraded func()
+
+	// MaxDelayJitter is the amount of absolute jitter added to delays that
+	// have reached MaxDelay.
+	//
+	// Delays that have reached MaxDelay are spread uniformly within
+	// ±MaxDelayJitter, on top of the proportional Jitter. This keeps clients
+	// that have all saturated at MaxDelay from synchronizing, even if
+	// proportional jitter is disabled with NoJitter.
+	//
+	// Defaults to 0 (no absolute jitter), can't be negative.
+	MaxDelayJitter time.Duration
+
+	// Heartbeat is called periodically while waiting to retry
+	//
+	// Defaults to zero value (no heartbeat).
+	Heartbeat Heartbeat
+
+	// InterruptOn is a set of channels that end the delay before the next
+	// attempt early
+	//
+	// Receiving from any of them makes the next attempt happen immediately,
+	// e.g. once an external signal tells that conditions have changed.
+	// Unlike cancelling the context, interrupts never stop the retries. A
+	// closed channel ends every delay.
+	//
+	// Defaults to nil (delays are not interrupted).
+	InterruptOn []<-chan struct{}
+
+	// Limiter is waited on before each attempt.
+	//
+	// The wait happens after PreDelay or the delay between attempts, so the
+	// limiter may extend the delay but never shortens it. If Wait returns an
+	// error, Do returns it.
+	//
+	// Defaults to nil (no rate limiting).
+	Limiter Limiter
+
+	// WaitFor is called before each attempt, including the first one, to
+	// wait until the attempt can succeed, e.g. until a leader is elected.
+	//
+	// It is called after PreDelay or the delay between attempts, and before
+	// Limiter. It should return once ready, or return an error once its
+	// context is done. If it returns an error, Do returns it.
+	//
+	// Defaults to nil (attempts are not gated).
+	WaitFor func(ctx context.Context) error
+
 	// Timeout is a maximum total time to retry.
 	//
 	// If timeout is reached then the context passed to the called function
@@ -49,26 +267,444 @@ type Config struct {
 	// Note that if called function should handle context cancellation
 	// for aborting the operation by timeout.
 	//
-	// Defaults to no timeout.
+	// If the function returns an error wrapping the context error, such as
+	// "reading response: context deadline exceeded", Do returns that error
+	// rather than the bare context error.
+	//
+	// Defaults to the time remaining until the deadline of the context passed
+	// to Do, if any, and to no timeout otherwise. An explicit Timeout
+	// overrides the context deadline (though it can't extend it).
 	Timeout time.Duration
 
+	// CleanTimeoutError makes Do return ErrTimeout instead of
+	// context.DeadlineExceeded once Timeout is reached.
+	//
+	// ErrTimeout wraps context.DeadlineExceeded, so errors.Is matches both.
+	// Errors returned by fn and deadline of the context passed to Do are
+	// not affected.
+	//
+	// Defaults to false.
+	CleanTimeoutError bool
+
+	// NoRetry makes Do call fn only once.
+	//
+	// ErrRetry and ErrRestart returned by fn are unwrapped, and their cause
+	// is returned to the caller without sleeping, even if they are wrapped
+	// in other errors. This allows turning retries off without changing fn.
+	// Do never returns ErrRetry or ErrRestart themselves, and never turns
+	// them into nil.
+	//
+	// Defaults to false.
+	NoRetry bool
+
+	// MaxTotalAttempts is a maximum number of calls to fn, including the
+	// ones after ErrRestart
+	//
+	// Once it is reached, Do returns the last error wrapped together with
+	// ErrTotalAttemptsExhausted. ErrRestart does not reset the count, so this
+	// bounds the total work even if fn keeps restarting.
+	//
+	// Defaults to 0 (no limit), can't be negative.
+	MaxTotalAttempts int
+
+	// RetryOn is a list of errors that trigger a retry without being wrapped
+	// in ErrRetry.
+	//
+	// Errors are matched with errors.Is. StopOn takes precedence over RetryOn.
+	//
+	// Defaults to nil (only ErrRetry and ErrRestart trigger a retry).
+	RetryOn []error
+
+	// StopOn is a list of errors that end the retry, even if fn wraps them
+	// in ErrRetry or ErrRestart.
+	//
+	// Errors are matched with errors.Is. The matching error is returned to
+	// the caller with ErrRetry or ErrRestart wrapper removed.
+	//
+	// Defaults to nil (errors are classified by ErrRetry and ErrRestart only).
+	StopOn []error
+
+	// TransientErrors receives every retriable error returned by fn, as it
+	// happens.
+	//
+	// Errors are sent without blocking: if the channel is not ready to
+	// receive, the error is dropped. Use a buffered channel to avoid losing
+	// errors to a slow reader. The channel is not closed by Do.
+	//
+	// Defaults to nil (errors are not sent).
+	TransientErrors chan<- error
+
+	// AttemptContext derives the context for each attempt
+	//
+	// It is called with the context of the retry and the number of the
+	// attempt (counted from 1 and not reset by ErrRestart), and returns the
+	// context to pass to fn and a function to call when the attempt ends.
+	// The function is called even if fn panics. This allows e.g. starting a
+	// tracing span for each attempt, or limiting the time of each attempt
+	// with context.WithTimeout. The context of the retry carries the
+	// deadline set by Timeout, so such per-attempt deadline never exceeds
+	// the time remaining for the retries.
+	//
+	// Defaults to nil (fn receives the context of the retry).
+	AttemptContext func(ctx context.Context, attempt int) (context.Context, func())
+
+	// Refresh is called before retrying after errors matched by RefreshOn,
+	// e.g. to refresh an expired authentication token
+	//
+	// It is called after the delay, right before the next attempt. If it
+	// returns an error, Do gives up and returns that error.
+	//
+	// Defaults to nil (no refresh).
+	Refresh func(ctx context.Context) error
+
+	// RefreshOn selects errors after which Refresh is called
+	//
+	// It receives the error returned by fn, unwrapped from ErrRetry or
+	// ErrRestart.
+	//
+	// Defaults to nil (Refresh is called before every retry).
+	RefreshOn func(err error) bool
+
+	// FreshContextPerAttempt makes each attempt receive its own context
+	//
+	// The context is derived from the context of the retry, so it shares
+	// its deadline, and is cancelled once the attempt ends. This keeps
+	// anything bound to the context of one attempt, e.g. goroutines started
+	// by fn, from outliving it.
+	//
+	// Defaults to false (all attempts between restarts share a context).
+	FreshContextPerAttempt bool
+
+	// OnFirstAttempt is called once, just before the first call to fn
+	//
+	// It is called after PreDelay, WaitFor and Limiter with the context of
+	// the retry, so it is not called at all if Do gives up before calling
+	// fn.
+	// This is useful for lazy initialization, such as starting a span.
+	//
+	// Defaults to nil (no callback).
+	OnFirstAttempt func(ctx context.Context)
+
+	// OnAttemptEnd is called after each call to fn returns
+	//
+	// It receives the number of the attempt (counted from 1 and not reset
+	// by ErrRestart), the time fn took and the error it returned.
+	//
+	// Defaults to nil (no callback).
+	OnAttemptEnd func(attempt int, dur time.Duration, err error)
+
+	// OnRetryDecide is called before waiting to retry, and stops the retries
+	// if it returns false
+	//
+	// It receives the number of the failed attempt (counted from 1 and not
+	// reset by ErrRestart), the delay before the next attempt and the error
+	// returned by fn. It is only called once a retry is otherwise decided
+	// on, so NoRetry, non-retriable errors and StopAtMaxDelay take
+	// precedence. If it returns false, Do returns the error without waiting.
+	// Timeout and the context are still honored while waiting.
+	//
+	// Defaults to nil (always retry).
+	OnRetryDecide func(attempt int, delay time.Duration, err error) bool
+
+	// OnScheduled is called before waiting to retry, with the delay and the
+	// time of the next attempt, e.g. to show a countdown
+	//
+	// It receives the final delay, after jitter and DelayMiddlewares are
+	// applied. Limiter may still postpone the attempt.
+	//
+	// Defaults to nil (no callback).
+	OnScheduled func(nextDelay time.Duration, nextAttemptAt time.Time)
+
+	// MaxConsecutiveSameError is a number of identical retriable errors in
+	// a row after which Do gives up
+	//
+	// Errors are compared by LogDedupKey. A different error and ErrRestart
+	// reset the count. Do returns the last error, unwrapped.
+	//
+	// Defaults to 0 (no limit), can't be negative.
+	MaxConsecutiveSameError int
+
+	// JoinDistinctErrors makes Do join the distinct retriable errors returned
+	// by fn into the error returned when it gives up after them, e.g. when
+	// the context is done or a limit on attempts is reached. The error
+	// returned by OnExhausted is returned as is.
+	//
+	// Errors are deduplicated by LogDedupKey and kept in the order they were
+	// first seen, up to 100 distinct errors.
+	//
+	// Defaults to false (only the error ending the retries is returned).
+	JoinDistinctErrors bool
+
+	// OnGiveUp is called once when Do ends without success
+	//
+	// It receives the reason, the last error returned by fn (nil if fn was
+	// not called) and the total number of attempts made. It is not called
+	// for invalid configs.
+	//
+	// Defaults to nil (no callback).
+	OnGiveUp func(reason GiveUpReason, lastErr error, attempts int)
+
+	// OnExhausted is called when a limit on attempts or time ends the
+	// retries: NoRetry, MaxTotalAttempts, or Timeout reached while waiting
+	// to retry
+	//
+	// It receives the last error returned by fn, unwrapped from ErrRetry or
+	// ErrRestart, and the total number of attempts made. Its return value
+	// is returned by Do, so returning nil makes Do succeed.
+	//
+	// Defaults to nil (Do returns the error it would return otherwise:
+	// the last error for NoRetry, ErrTotalAttemptsExhausted wrapped with it
+	// for MaxTotalAttempts, and context.DeadlineExceeded for Timeout).
+	OnExhausted func(lastErr error, attempts int) error
+
+	// RetryOnCtxError makes context.DeadlineExceeded returned by fn
+	// retriable, as long as the context passed to fn is not done.
+	//
+	// This allows fn to apply its own per-attempt deadlines without wrapping
+	// the resulting errors in ErrRetry. If the deadline of the overall
+	// context or Timeout is reached, the error is returned as usual.
+	//
+	// Defaults to false.
+	RetryOnCtxError bool
+
+	// Name is a name of the retried operation
+	//
+	// If set, it is added to log records as "op" attribute.
+	//
+	// Defaults to "" (no name).
+	Name string
+
+	// Group collapses concurrent retries with the same Name into one.
+	//
+	// Calls of Do made while a retry with the same Name runs in the group
+	// wait for it and return its error, ignoring their own fn and config.
+	// The shared retry runs with the context of the call that started it,
+	// so cancelling that context ends it for all callers. A waiting call
+	// returns early once its own context is done. If fn panics, the waiting
+	// calls return ErrGroupPanic. Only the error is shared, so Do1 and
+	// other functions returning values get zero values in the waiting
+	// calls.
+	//
+	// Name is required if Group is set. Defaults to nil (no deduplication).
+	Group *Group
+
+	// SlowAttemptThreshold is a duration of an attempt after which a warning
+	// is logged
+	//
+	// This helps detecting called functions that lack internal timeouts. It
+	// does not affect the retries.
+	//
+	// Defaults to 0 (no warning).
+	SlowAttemptThreshold time.Duration
+
 	// Logger is a logger for retries
 	//
 	// This package logs retriable errors returned by an invoked function.
-	// It omits logging identical subsequent errors.
+	// It omits logging identical subsequent errors. ErrRestart starts
+	// over, so the first error after a restart is always logged.
+	//
+	// If the error wraps other errors, its root cause is logged as
+	// "root_cause" attribute.
 	//
 	// Defaults to slog.Default. Set to NoLog to disable logging.
 	Logger *slog.Logger
 
+	// LogDedupKey returns a key used to detect identical subsequent errors
+	// for logging
+	//
+	// Errors with the same key are considered identical, e.g. errors of the
+	// same type or with the same error code.
+	//
+	// Defaults to error message.
+	LogDedupKey func(error) string
+
+	// LogSampleEvery makes only every Nth retriable error logged, in
+	// addition to the first one
+	//
+	// Sampling applies to errors that are not omitted as identical to the
+	// previous ones. ErrRestart starts over, so the first error after a
+	// restart is always logged.
+	//
+	// Defaults to 0 (all errors are logged), can't be negative.
+	LogSampleEvery int
+
+	// LogContextAttrs extracts attributes to add to each log record from the
+	// context of the retry, e.g. a trace ID or a request ID
+	//
+	// Defaults to nil (no attributes from the context).
+	LogContextAttrs func(ctx context.Context) []slog.Attr
+
 	// LogLevel is a log level for retries
 	//
 	// Defaults to slog.Debug.
 	LogLevel slog.Level
 
+	// FirstErrorLogLevel is a log level for the first retriable error
+	//
+	// This allows the first failure to be logged prominently, while the
+	// subsequent ones are logged at LogLevel. ErrRestart starts over, so the
+	// first error after a restart is logged at this level too.
+	//
+	// Defaults to LogLevel.
+	FirstErrorLogLevel slog.Level
+
+	// LogTransitionsOnly makes Do log only the transitions between failure
+	// and success, instead of retriable errors
+	//
+	// The first failure is logged at FirstErrorLogLevel as "entering retry",
+	// and the eventual success at LogLevel as "recovered", with the number
+	// of attempts as "attempts" attribute. Giving up is logged as with
+	// LogGiveUp.
+	//
+	// Defaults to false (retriable errors are logged).
+	LogTransitionsOnly bool
+
+	// LogGiveUp makes Do log the error it returns when it gives up
+	//
+	// The error is logged at LogLevel as "giving up", with the reason as
+	// "reason" attribute. Callers that log the returned error themselves
+	// should leave it off to avoid logging it twice.
+	//
+	// Defaults to false (only retriable errors are logged).
+	LogGiveUp bool
+
+	// Rand is a source of randomness for jitter
+	//
+	// A seeded source makes delays reproducible. rand.Rand is not safe for
+	// concurrent use, so a Rand must not be shared by concurrent calls to Do.
+	//
+	// Defaults to nil (global source of math/rand).
+	Rand *rand.Rand
+
+	// SeedFromContext returns a seed for jitter of this call of Do, e.g.
+	// derived from a request ID in the context
+	//
+	// If it returns true, delays are drawn from a source seeded with the
+	// returned seed, so they can be reproduced from the context. It takes
+	// precedence over Rand.
+	//
+	// Defaults to nil (Rand is used).
+	SeedFromContext func(ctx context.Context) (seed int64, ok bool)
+
+	// RandObserver is called with every random value consumed for jitter
+	//
+	// It is intended for auditing the randomness source. It does not affect
+	// the delays.
+	//
+	// Defaults to nil (no observer).
+	RandObserver func(float64)
+
+	// StrictValidate makes Validate also reject configs that are valid,
+	// but are likely mistakes: MaxDelay less than Delay, so that every
+	// delay is clamped to MaxDelay. MaxDelay equal to Delay with Scale
+	// above 1 is only logged at debug level by Do, as scaling is a no-op.
+	//
+	// Defaults to false.
+	StrictValidate bool
+
 	// Override time.After, only for tests
 	timeAfter func(d time.Duration) <-chan time.Time
+
+	// Override time.After for Timeout, only for tests
+	timeoutAfter func(d time.Duration) <-chan time.Time
+
+	// Override time.Now, only for tests
+	now func() time.Time
+}
+
+// Limiter is a rate limiter, such as golang.org/x/time/rate.Limiter
+type Limiter interface {
+	// Wait blocks until an attempt is allowed or ctx is done
+	Wait(ctx context.Context) error
+}
+
+// Heartbeat reports progress of long delays between attempts, e.g. to show
+// a countdown to the next retry
+type Heartbeat struct {
+	// Interval is a time between calls to Fn.
+	//
+	// This field is required if Fn is set.
+	Interval time.Duration
+
+	// Fn is called every Interval during delays longer than Interval, with
+	// the time remaining until the next attempt. It is not called once the
+	// delay ends or the context is done.
+	Fn func(remaining time.Duration)
+}
+
+// ErrMaxDelayReached is returned, wrapped together with the last error, when
+// Do gives up due to Config.StopAtMaxDelay
+var ErrMaxDelayReached = errors.New("max delay reached")
+
+// ErrTimeout is returned instead of context.DeadlineExceeded when
+// Config.Timeout is reached, if Config.CleanTimeoutError is set
+//
+// It wraps context.DeadlineExceeded.
+var ErrTimeout = fmt.Errorf("retry timed out: %w", context.DeadlineExceeded)
+
+// ErrTotalAttemptsExhausted is returned, wrapped together with the last
+// error, when Do gives up due to Config.MaxTotalAttempts
+var ErrTotalAttemptsExhausted = errors.New("total attempts exhausted")
+
+// GiveUpReason is a reason for Do to end without success
+type GiveUpReason int
+
+const (
+	// GiveUpTimeout means Timeout or the deadline of the context was reached
+	GiveUpTimeout GiveUpReason = iota + 1
+	// GiveUpMaxAttempts means no more attempts are allowed
+	GiveUpMaxAttempts
+	// GiveUpContextCancelled means the context was cancelled
+	GiveUpContextCancelled
+	// GiveUpPermanentError means fn returned an error that is not retriable
+	GiveUpPermanentError
+	// GiveUpMaxDelayReached means delay has reached MaxDelay, see
+	// Config.StopAtMaxDelay
+	GiveUpMaxDelayReached
+	// GiveUpDeclined means Config.OnRetryDecide declined to retry
+	GiveUpDeclined
+	// GiveUpRepeatedError means fn returned the same error too many times in
+	// a row, see Config.MaxConsecutiveSameError
+	GiveUpRepeatedError
+	// GiveUpRefreshFailed means Config.Refresh returned an error
+	GiveUpRefreshFailed
+	// GiveUpInvalidDelay means Config.NextDelay, Config.MaxDelayFunc or
+	// Config.DelayCeilingFunc returned a negative delay
+	GiveUpInvalidDelay
+)
+
+func (r GiveUpReason) String() string {
+	switch r {
+	case GiveUpTimeout:
+		return "timeout"
+	case GiveUpMaxAttempts:
+		return "max attempts"
+	case GiveUpContextCancelled:
+		return "context cancelled"
+	case GiveUpPermanentError:
+		return "permanent error"
+	case GiveUpMaxDelayReached:
+		return "max delay reached"
+	case GiveUpDeclined:
+		return "retry declined"
+	case GiveUpRepeatedError:
+		return "repeated error"
+	case GiveUpRefreshFailed:
+		return "refresh failed"
+	case GiveUpInvalidDelay:
+		return "invalid delay"
+	default:
+		return fmt.Sprintf("GiveUpReason(%d)", int(r))
+	}
 }
 
+// ErrStop is returned by fn to end the retries successfully
+//
+// Do returns nil, even if ErrStop is wrapped in ErrRetry or other errors.
+// This gives polling functions a way to stop once they are done, while
+// Do1 returns the value returned along with ErrStop.
+var ErrStop = errors.New("stop retrying")
+
 // ErrRetry signals the retry attempt
 type ErrRetry struct {
 	err error
@@ -92,6 +728,55 @@ func Retriable(err error) error {
 	return ErrRetry{err}
 }
 
+// RetriableUnless wraps the error in ErrRetry if it is not nil and terminal
+// does not match it
+//
+// Typical usage is to wrap errors of an operation where most errors are
+// transient and only a few are known to be fatal.
+func RetriableUnless(err error, terminal func(error) bool) error {
+	if err == nil || terminal(err) {
+		return err
+	}
+	return ErrRetry{err}
+}
+
+// RetriableLoud is a version of Retriable for errors that are retriable
+// but alarming, e.g. repeated authentication failures
+//
+// The error is logged at slog.LevelError regardless of Config.LogLevel.
+// Do returns it unwrapped, as it returns errors wrapped by Retriable.
+func RetriableLoud(err error) error {
+	if err == nil {
+		return nil
+	}
+	return ErrRetry{loudError{err}}
+}
+
+// loudError marks an error wrapped by RetriableLoud
+type loudError struct {
+	err error
+}
+
+func (e loudError) Error() string {
+	return e.err.Error()
+}
+
+func (e loudError) Unwrap() error {
+	return e.err
+}
+
+// isLoud reports whether err has been wrapped by RetriableLoud
+//
+// Only single-error wrapping is followed, so that it does not allocate.
+func isLoud(err error) bool {
+	for ; err != nil; err = errors.Unwrap(err) {
+		if _, ok := err.(loudError); ok {
+			return true
+		}
+	}
+	return false
+}
+
 // ErrRestart signals the restart of retry attempts, resetting both delay and timeout
 type ErrRestart struct {
 	err error
@@ -115,107 +800,633 @@ func Restartable(err error) error {
 	return ErrRestart{err}
 }
 
+// classify reports whether err signals a retry or a restart
+//
+// It is equivalent to calling errors.As with ErrRetry and ErrRestart
+// targets, but walks the error tree once.
+func classify(err error) (doRetry, doRestart bool) {
+	for err != nil {
+		switch err.(type) {
+		case ErrRetry:
+			doRetry = true
+		case ErrRestart:
+			doRestart = true
+		}
+		if x, ok := err.(interface{ As(any) bool }); ok {
+			if !doRetry {
+				doRetry = x.As(&ErrRetry{})
+			}
+			if !doRestart {
+				doRestart = x.As(&ErrRestart{})
+			}
+		}
+		if doRetry && doRestart {
+			return
+		}
+
+		switch x := err.(type) {
+		case interface{ Unwrap() error }:
+			err = x.Unwrap()
+		case interface{ Unwrap() []error }:
+			for _, err := range x.Unwrap() {
+				retry, restart := classify(err)
+				doRetry = doRetry || retry
+				doRestart = doRestart || restart
+			}
+			return
+		default:
+			return
+		}
+	}
+	return
+}
+
+// classifyAttempt classifies the error returned by an attempt according to
+// cfg
+//
+// ErrStop is turned into success, and RetryOnCtxError, RetryOn and StopOn
+// are applied on top of classify. stopped is set if StopOn matched an error
+// that would be retried otherwise. ctx is the context passed to the attempt.
+func classifyAttempt(ctx context.Context, cfg *Config, err error) (_ error, doRetry, doRestart, stopped bool) {
+	if err != nil && errors.Is(err, ErrStop) {
+		return nil, false, false, false
+	}
+
+	doRetry, doRestart = classify(err)
+
+	if !doRetry && !doRestart && cfg.RetryOnCtxError &&
+		errors.Is(err, context.DeadlineExceeded) && ctx.Err() == nil {
+		doRetry = true
+	}
+
+	if !doRetry && !doRestart && isAny(err, cfg.RetryOn) {
+		doRetry = true
+	}
+
+	if (doRetry || doRestart) && isAny(err, cfg.StopOn) {
+		return err, false, false, true
+	}
+	return err, doRetry, doRestart, false
+}
+
+// cause returns the error wrapped in ErrRetry or ErrRestart, or err itself
+// if it is not a retry signal
+func cause(err error) error {
+	var errRetry ErrRetry
+	if errors.As(err, &errRetry) {
+		if loud, ok := errRetry.err.(loudError); ok {
+			return loud.err
+		}
+		return errRetry.err
+	}
+	var errRestart ErrRestart
+	if errors.As(err, &errRestart) {
+		return errRestart.err
+	}
+	return err
+}
+
+// effectiveTimeout returns timeout, or the time remaining until the deadline
+// of ctx if timeout is not set
+func effectiveTimeout(ctx context.Context, timeout time.Duration, now time.Time) time.Duration {
+	if timeout != 0 {
+		return timeout
+	}
+	if deadline, ok := ctx.Deadline(); ok && deadline.After(now) {
+		return deadline.Sub(now)
+	}
+	return 0
+}
+
+// isAny reports whether err matches any of targets
+func isAny(err error, targets []error) bool {
+	for _, target := range targets {
+		if errors.Is(err, target) {
+			return true
+		}
+	}
+	return false
+}
+
 // Do runs fn with retries controlled by config
 //
-// fn triggers a retry by returning ErrRetry or ErrRestart.
-// Any other return value ends the retry and is returned
-// to the caller.
+// fn triggers a retry by returning ErrRetry or ErrRestart, or an error
+// matching Config.RetryOn, unless the error matches Config.StopOn.
+// Any other return value ends the retry and is returned to the caller.
 //
 // Context passed to fn is valid only during one attempt,
 // and may or may not be canceled afterwards.
 func Do(ctx context.Context, cfg Config, fn func(ctx context.Context) error) error {
 	// This code modifiers cfg, so it is passed by value
 
-	if cfg.Delay == 0 {
-		return fmt.Errorf("no delay is specified")
-	}
-
-	if cfg.Scale == 0 {
-		cfg.Scale = 1
+	if err := cfg.Validate(); err != nil {
+		return err
 	}
-	if cfg.Scale != 0 && cfg.Scale < 1 {
-		return fmt.Errorf("scale can't be less than 1")
+	if cfg.Group != nil {
+		group := cfg.Group
+		cfg.Group = nil
+		return group.do(ctx, cfg.Name, func() error {
+			return Do(ctx, cfg, fn)
+		})
 	}
+	cfg.setDefaults()
 
-	switch cfg.Jitter {
-	case NoJitter:
-		cfg.Jitter = 0
-	case 0:
-		cfg.Jitter = 0.125
-	}
-	if cfg.Jitter < 0 || cfg.Jitter > 1 {
-		return fmt.Errorf("jitter has to be within [0,1]")
+	l := retryLogger{
+		logger:          cfg.Logger,
+		level:           cfg.LogLevel,
+		firstLevel:      cfg.FirstErrorLogLevel,
+		name:            cfg.Name,
+		dedupKey:        cfg.LogDedupKey,
+		sampleEvery:     cfg.LogSampleEvery,
+		contextAttrs:    cfg.LogContextAttrs,
+		transitionsOnly: cfg.LogTransitionsOnly,
 	}
 
-	if cfg.MaxDelay == 0 {
-		cfg.MaxDelay = 1<<63 - 1 // time.go:maxDuration
+	if cfg.StrictValidate && cfg.BackoffSchedule == nil && cfg.NextDelay == nil && cfg.MaxDelay == cfg.Delay && cfg.Scale > 1 {
+		l.logNoScaling(ctx)
 	}
 
-	if cfg.timeAfter == nil {
-		cfg.timeAfter = time.After
+	b := backoff{
+		phases: []BackoffPhase{{Delay: cfg.Delay, Scale: cfg.Scale}},
+		now:    cfg.now,
+	}
+	if cfg.BackoffSchedule != nil {
+		b.phases = cfg.BackoffSchedule
+		b.capPhaseStart = true
 	}
 
 	var innerCtx context.Context
 	var innerCtxDone func()
 	defer func() {
-		// This function will be nil if there is no timeout specified in the config
+		// This function will be nil if Timeout does not bound the retries
 		if innerCtxDone != nil {
 			innerCtxDone()
 		}
 	}()
 
-	if cfg.Timeout == 0 {
+	// boundRetries derives the context of the retries from ctx, bounded by
+	// Timeout. The deadline of ctx, if it comes first, bounds the retries by
+	// itself.
+	boundRetries := func() {
+		if innerCtxDone != nil {
+			innerCtxDone() // close the previous context
+			innerCtxDone = nil
+		}
 		innerCtx = ctx
-	} else {
-		innerCtx, innerCtxDone = context.WithTimeout(ctx, cfg.Timeout)
+		if timeout := effectiveTimeout(ctx, cfg.Timeout, cfg.now()); timeout != 0 {
+			if deadline, ok := ctx.Deadline(); !ok || deadline.After(cfg.now().Add(timeout)) {
+				innerCtx, innerCtxDone = withTimeout(ctx, timeout, cfg.timeoutAfter, cfg.now)
+			}
+		}
 	}
+	boundRetries()
 
+	attempts := 0 // total, for reporting
+	var lastErr error
+
+	distinct := distinctErrors{key: cfg.LogDedupKey}
+
+	// giveUp reports the end of retries without success
+	giveUp := func(reason GiveUpReason, err error) error {
+		if err == nil {
+			return nil
+		}
+		if cfg.CleanTimeoutError && err == context.DeadlineExceeded && ctx.Err() == nil {
+			err = ErrTimeout
+		}
+		if cfg.JoinDistinctErrors {
+			err = distinct.join(err)
+		}
+		if cfg.LogGiveUp || cfg.LogTransitionsOnly {
+			l.logGiveUp(ctx, reason, err)
+		}
+		if cfg.OnGiveUp != nil {
+			cfg.OnGiveUp(reason, lastErr, attempts)
+		}
+		return err
+	}
+	ctxReason := func() GiveUpReason {
+		if errors.Is(innerCtx.Err(), context.DeadlineExceeded) {
+			return GiveUpTimeout
+		}
+		return GiveUpContextCancelled
+	}
+
+	// boundaryAttempt is set if Timeout is reached during PreDelay, but
+	// PreDelayBestEffort allows one attempt anyway
+	var boundaryAttempt bool
 	if cfg.PreDelay > 0 {
+		var preDelayDone <-chan struct{} // nil channel blocks forever
+		if cfg.PreDelayCtx != nil {
+			preDelayDone = cfg.PreDelayCtx.Done()
+		}
 		select {
 		case <-cfg.timeAfter(cfg.PreDelay): // Doesn't leak since Go 1.23, https://github.com/golang/go/issues/8898
+		case <-preDelayDone:
 		case <-innerCtx.Done():
-			return innerCtx.Err()
+			if !cfg.PreDelayBestEffort || ctx.Err() != nil {
+				return giveUp(ctxReason(), innerCtx.Err())
+			}
+			boundaryAttempt = true
+		}
+	}
+
+	source := cfg.Rand
+	if cfg.SeedFromContext != nil {
+		if seed, ok := cfg.SeedFromContext(ctx); ok {
+			source = rand.New(rand.NewSource(seed))
+		}
+	}
+	random := func() float64 {
+		var rnd float64
+		if source != nil {
+			rnd = source.Float64()
+		} else {
+			rnd = rand.Float64()
+		}
+		if cfg.RandObserver != nil {
+			cfg.RandObserver(rnd)
+		}
+		return rnd
+	}
+
+	// Do not make a pointless attempt if the context passed to Do is
+	// already done. Timeout is not checked: the first attempt is made even
+	// if a short Timeout expires before it, as fn can see that anyway.
+	if err := ctx.Err(); err != nil {
+		return giveUp(ctxReason(), err)
+	}
+
+	var interruptCases []reflect.SelectCase
+	if len(cfg.InterruptOn) > 0 {
+		// The first cases are filled by waitDelay
+		interruptCases = make([]reflect.SelectCase, delayInterrupted, delayInterrupted+len(cfg.InterruptOn))
+		for _, ch := range cfg.InterruptOn {
+			interruptCases = append(interruptCases, reflect.SelectCase{Dir: reflect.SelectRecv, Chan: reflect.ValueOf(ch)})
 		}
 	}
 
-	delay := cfg.Delay
+	b.reset()
+	attempt := 0 // since the start or the last restart
+	start := cfg.now()
+	maxDelayStreak := 0
+	var prevDelay time.Duration
+	var sameErrKey string
+	sameErrCount := 0
+	degraded := false
 	for {
-		err := fn(innerCtx)
+		attemptCtx := innerCtx
+		if boundaryAttempt {
+			attemptCtx = ctx
+			boundaryAttempt = false
+		}
 
-		var errRetry ErrRetry
-		doRetry := errors.As(err, &errRetry)
-		var errRestart ErrRestart
-		doRestart := errors.As(err, &errRestart)
+		if cfg.WaitFor != nil {
+			if err := cfg.WaitFor(attemptCtx); err != nil {
+				if attemptCtx.Err() != nil {
+					return giveUp(ctxReason(), err)
+				}
+				return giveUp(GiveUpPermanentError, err)
+			}
+		}
 
-		if err == nil || (!doRetry && !doRestart) {
-			return err
+		if cfg.Limiter != nil {
+			if err := cfg.Limiter.Wait(attemptCtx); err != nil {
+				if attemptCtx.Err() != nil {
+					return giveUp(ctxReason(), err)
+				}
+				return giveUp(GiveUpPermanentError, err)
+			}
+		}
+
+		if attempts == 0 && cfg.OnFirstAttempt != nil {
+			cfg.OnFirstAttempt(attemptCtx)
+		}
+
+		attemptStart := cfg.now()
+		err := callAttempt(attemptCtx, cfg.FreshContextPerAttempt, cfg.AttemptContext, attempts+1, fn)
+		attemptDur := cfg.now().Sub(attemptStart)
+		attempts++
+		attempt++
+		lastErr = err
+		if cfg.SlowAttemptThreshold > 0 && attemptDur > cfg.SlowAttemptThreshold {
+			l.logSlowAttempt(innerCtx, attemptDur)
+		}
+		if cfg.OnAttemptEnd != nil {
+			cfg.OnAttemptEnd(attempts, attemptDur, err)
+		}
+		err, doRetry, doRestart, stopped := classifyAttempt(innerCtx, &cfg, err)
+		if stopped {
+			return giveUp(GiveUpPermanentError, cause(err))
+		}
+
+		if err == nil {
+			if attempts > 1 {
+				l.logRecovered(innerCtx, attempts)
+			}
+			return nil
+		}
+		if cfg.JoinDistinctErrors && (doRetry || doRestart) {
+			distinct.add(cause(err))
+		}
+
+		if !doRetry && !doRestart {
+			// fn interrupted by the context returns the context error
+			if ctxErr := innerCtx.Err(); ctxErr != nil && errors.Is(err, ctxErr) {
+				return giveUp(ctxReason(), err)
+			}
+			return giveUp(GiveUpPermanentError, err)
+		}
+
+		if cfg.NoRetry || cfg.MaxTotalAttempts > 0 && attempts >= cfg.MaxTotalAttempts {
+			switch {
+			case cfg.OnExhausted != nil:
+				distinct.errs = nil // the error returned by OnExhausted is returned as is
+				return giveUp(GiveUpMaxAttempts, cfg.OnExhausted(cause(err), attempts))
+			case cfg.NoRetry:
+				return giveUp(GiveUpMaxAttempts, cause(err))
+			default:
+				return giveUp(GiveUpMaxAttempts, fmt.Errorf("%w: %w", ErrTotalAttemptsExhausted, cause(err)))
+			}
+		}
+
+		if cfg.MaxConsecutiveSameError > 0 && !doRestart {
+			if key := cfg.LogDedupKey(err); sameErrCount > 0 && key == sameErrKey {
+				sameErrCount++
+			} else {
+				sameErrKey, sameErrCount = key, 1
+			}
+			if sameErrCount >= cfg.MaxConsecutiveSameError {
+				return giveUp(GiveUpRepeatedError, cause(err))
+			}
 		}
 
+		if cfg.TransientErrors != nil {
+			select {
+			case cfg.TransientErrors <- err:
+			default:
+			}
+		}
+
+		if attempts == 1 {
+			l.logEntering(innerCtx, err)
+		}
 		if doRestart {
-			delay = cfg.Delay
-			if cfg.Timeout != 0 {
-				innerCtxDone() // close the previous context
-				innerCtx, innerCtxDone = context.WithTimeout(ctx, cfg.Timeout)
-				_ = innerCtxDone // ignore false positive from lostcancel vet check
+			l.log(innerCtx, "restarting", err)
+			l.reset()
+			b.reset()
+			attempt = 1 // the restarting attempt is the first one of the new run
+			maxDelayStreak = 0
+			prevDelay = 0
+			sameErrCount = 0
+			degraded = false
+			start = cfg.now()
+			if cfg.ContextFactory != nil {
+				ctx = cfg.ContextFactory()
 			}
+			boundRetries() // restart Timeout, for the new context if any
+		} else {
+			l.log(innerCtx, "retrying", err)
 		}
 
-		jitteredDelay := time.Duration(float64(delay) * (1 + 2*rand.Float64()*cfg.Jitter - cfg.Jitter))
+		var jitteredDelay time.Duration
+		if cfg.NextDelay != nil {
+			jitteredDelay = cfg.NextDelay(attempt, prevDelay, err)
+			if jitteredDelay < 0 {
+				return giveUp(GiveUpInvalidDelay, fmt.Errorf("next delay func returned negative delay %v", jitteredDelay))
+			}
+			if !cfg.NextDelayUncapped {
+				jitteredDelay = min(jitteredDelay, cfg.MaxDelay)
+			}
+		} else {
+			rnd := random()
+			maxDelay := cfg.MaxDelay
+			var dynamicMaxDelay time.Duration
+			if cfg.MaxDelayFunc != nil {
+				switch d := cfg.MaxDelayFunc(attempt, cfg.now().Sub(start)); {
+				case d < 0:
+					return giveUp(GiveUpInvalidDelay, fmt.Errorf("max delay func returned negative delay %v", d))
+				case d > 0:
+					dynamicMaxDelay = d
+				}
+			}
+			if cfg.DelayCeilingFunc != nil {
+				switch d := cfg.DelayCeilingFunc(cfg.now()); {
+				case d < 0:
+					return giveUp(GiveUpInvalidDelay, fmt.Errorf("delay ceiling func returned negative delay %v", d))
+				case d > 0 && (dynamicMaxDelay == 0 || d < dynamicMaxDelay):
+					dynamicMaxDelay = d
+				}
+			}
+			if dynamicMaxDelay > 0 {
+				maxDelay = dynamicMaxDelay
+			}
+			var delay time.Duration
+			if attempt == 1 && cfg.FirstDelay > 0 {
+				delay = min(cfg.FirstDelay, maxDelay)
+			} else {
+				delay = b.next(maxDelay)
+				if cfg.MaxDelayFunc != nil || cfg.DelayCeilingFunc != nil {
+					delay = min(delay, maxDelay)
+				}
+			}
 
-		select {
-		case <-cfg.timeAfter(jitteredDelay): // Doesn't leak since Go 1.23, https://github.com/golang/go/issues/8898
-		case <-innerCtx.Done():
-			return innerCtx.Err()
+			if cfg.OnDegraded != nil && !degraded && delay >= maxDelay {
+				degraded = true
+				cfg.OnDegraded()
+			}
+
+			if cfg.StopAtMaxDelay {
+				switch {
+				case delay < maxDelay:
+					// A dynamic cap may have grown, breaking the streak
+					maxDelayStreak = 0
+				case maxDelayStreak == cfg.MaxDelayStreak:
+					return giveUp(GiveUpMaxDelayReached, fmt.Errorf("%w: %w", ErrMaxDelayReached, cause(err)))
+				default:
+					maxDelayStreak++
+				}
+			}
+
+			switch {
+			case cfg.JitterAttempts > 0 && attempts > cfg.JitterAttempts:
+				jitteredDelay = delay
+			case cfg.JitterFloorFraction > 0:
+				jitteredDelay = applyJitterFloor(delay, cfg.Jitter, cfg.JitterFloorFraction, rnd)
+			default:
+				jitteredDelay = applyJitter(delay, cfg.Jitter, rnd)
+			}
+			if cfg.MaxJitterAbsolute > 0 {
+				jitteredDelay = max(delay-cfg.MaxJitterAbsolute, min(delay+cfg.MaxJitterAbsolute, jitteredDelay))
+			}
+			if cfg.MaxDelayJitter > 0 && delay >= maxDelay && (cfg.JitterAttempts == 0 || attempts <= cfg.JitterAttempts) {
+				jitteredDelay = max(0, jitteredDelay+time.Duration((2*random()-1)*float64(cfg.MaxDelayJitter)))
+			}
+		}
+		for _, mw := range cfg.DelayMiddlewares {
+			jitteredDelay = max(0, mw(attempt, jitteredDelay))
+		}
+		prevDelay = jitteredDelay
+
+		if cfg.OnRetryDecide != nil && !cfg.OnRetryDecide(attempts, jitteredDelay, cause(err)) {
+			return giveUp(GiveUpDeclined, cause(err))
+		}
+		if cfg.OnScheduled != nil {
+			cfg.OnScheduled(jitteredDelay, cfg.now().Add(jitteredDelay))
+		}
+
+		wake := cfg.timeAfter(jitteredDelay) // Doesn't leak since Go 1.23, https://github.com/golang/go/issues/8898
+		var tick <-chan time.Time            // nil channel blocks forever
+		var wakeAt time.Time
+		if cfg.Heartbeat.Fn != nil && jitteredDelay > cfg.Heartbeat.Interval {
+			wakeAt = cfg.now().Add(jitteredDelay)
+			tick = cfg.timeAfter(cfg.Heartbeat.Interval)
+		}
+	sleep:
+		for {
+			switch waitDelay(wake, tick, innerCtx.Done(), interruptCases) {
+			case delayEnded, delayInterrupted:
+				break sleep
+			case delayTick:
+				if remaining := wakeAt.Sub(cfg.now()); remaining > 0 {
+					cfg.Heartbeat.Fn(remaining)
+				}
+				tick = cfg.timeAfter(cfg.Heartbeat.Interval)
+			case delayCtxDone:
+				if cfg.OnExhausted != nil && ctx.Err() == nil && errors.Is(innerCtx.Err(), context.DeadlineExceeded) {
+					distinct.errs = nil // the error returned by OnExhausted is returned as is
+					return giveUp(GiveUpTimeout, cfg.OnExhausted(cause(err), attempts))
+				}
+				// fn interrupted by the context may have returned a more
+				// descriptive version of the context error
+				if lastErr := cause(err); errors.Is(lastErr, innerCtx.Err()) {
+					return giveUp(ctxReason(), lastErr)
+				}
+				return giveUp(ctxReason(), innerCtx.Err())
+			}
 		}
 
-		delay = time.Duration(float64(delay) * cfg.Scale)
-		if delay > cfg.MaxDelay {
-			delay = cfg.MaxDelay
+		if cfg.Refresh != nil && (cfg.RefreshOn == nil || cfg.RefreshOn(cause(err))) {
+			if err := cfg.Refresh(innerCtx); err != nil {
+				return giveUp(GiveUpRefreshFailed, err)
+			}
 		}
 	}
 }
 
+// Events ending a wait in waitDelay
+const (
+	delayEnded = iota
+	delayTick
+	delayCtxDone
+	delayInterrupted
+)
+
+// waitDelay waits until one of the channels is ready, and reports which one
+//
+// If interruptCases is not nil, it holds select cases for the interrupting
+// channels, after delayInterrupted cases reserved for the other channels.
+func waitDelay(wake, tick <-chan time.Time, ctxDone <-chan struct{}, interruptCases []reflect.SelectCase) int {
+	if interruptCases == nil {
+		select {
+		case <-wake:
+			return delayEnded
+		case <-tick:
+			return delayTick
+		case <-ctxDone:
+			return delayCtxDone
+		}
+	}
+
+	interruptCases[delayEnded] = reflect.SelectCase{Dir: reflect.SelectRecv, Chan: reflect.ValueOf(wake)}
+	interruptCases[delayTick] = reflect.SelectCase{Dir: reflect.SelectRecv, Chan: reflect.ValueOf(tick)}
+	interruptCases[delayCtxDone] = reflect.SelectCase{Dir: reflect.SelectRecv, Chan: reflect.ValueOf(ctxDone)}
+	chosen, _, _ := reflect.Select(interruptCases)
+	return min(chosen, delayInterrupted)
+}
+
+// callAttempt calls fn, in a fresh context if requested, further derived by
+// attemptContext if it is set
+func callAttempt(ctx context.Context, fresh bool, attemptContext func(context.Context, int) (context.Context, func()),
+	attempt int, fn func(ctx context.Context) error) error {
+	if fresh {
+		var cancel func()
+		ctx, cancel = context.WithCancel(ctx)
+		defer cancel()
+	}
+	if attemptContext != nil {
+		var done func()
+		ctx, done = attemptContext(ctx, attempt)
+		defer done()
+	}
+	return fn(ctx)
+}
+
+// maxDistinctErrors bounds the number of errors kept by distinctErrors
+const maxDistinctErrors = 100
+
+// distinctErrors collects distinct errors in the order they were first seen
+type distinctErrors struct {
+	key  func(error) string
+	seen map[string]bool
+	errs []error
+}
+
+// join returns the collected errors joined with err, the error ending the
+// retries, unless err is one of them
+func (d *distinctErrors) join(err error) error {
+	if len(d.errs) == 0 {
+		return err
+	}
+	if d.seen[d.key(err)] {
+		return errors.Join(d.errs...)
+	}
+	return errors.Join(append(slices.Clip(d.errs), err)...)
+}
+
+func (d *distinctErrors) add(err error) {
+	if len(d.errs) == maxDistinctErrors {
+		return
+	}
+	key := d.key(err)
+	if d.seen[key] {
+		return
+	}
+	if d.seen == nil {
+		d.seen = map[string]bool{}
+	}
+	d.seen[key] = true
+	d.errs = append(d.errs, err)
+}
+
+// applyJitter spreads base uniformly within ±jitter of its value
+//
+// rnd is a random value within [0,1), rnd of 0.5 yields base.
+func applyJitter(base time.Duration, jitter float64, rnd float64) time.Duration {
+	if jitter == NoJitter {
+		return base
+	}
+	return time.Duration(float64(base) * (1 + 2*rnd*jitter - jitter))
+}
+
+// applyJitterFloor spreads base uniformly within ±jitter of its value,
+// excluding the band within ±floor of it
+//
+// rnd is a random value within [0,1), values below 0.5 decrease base.
+func applyJitterFloor(base time.Duration, jitter, floor float64, rnd float64) time.Duration {
+	u := 2*rnd - 1
+	offset := floor + (jitter-floor)*math.Abs(u)
+	if u < 0 {
+		offset = -offset
+	}
+	return time.Duration(float64(base) * (1 + offset))
+}
+
 // Do1 is a version of Do with one return value
+//
+// The value returned by the last call to fn is returned along with the
+// error, even if it is not nil, so partial results are available on
+// failures. If fn is not called, the zero value is returned.
 func Do1[T any](ctx context.Context, cfg Config, fn func(ctx context.Context) (T, error)) (T, error) {
 	var ret T
 	err := Do(ctx, cfg, func(ctx context.Context) error {
@@ -225,3 +1436,112 @@ func Do1[T any](ctx context.Context, cfg Config, fn func(ctx context.Context) (T
 	})
 	return ret, err
 }
+
+// DoFirstTry is a version of Do that also reports whether fn succeeded on
+// the first attempt
+//
+// The returned bool is true iff fn returned nil on its initial call, with no
+// retries or restarts before it.
+func DoFirstTry(ctx context.Context, cfg Config, fn func(ctx context.Context) error) (bool, error) {
+	var attempts int
+	err := Do(ctx, cfg, func(ctx context.Context) error {
+		attempts++
+		return fn(ctx)
+	})
+	return err == nil && attempts == 1, err
+}
+
+// errRetryRequested is a cause of retry requested without an error
+var errRetryRequested = errors.New("retry requested")
+
+// DoBool is a version of Do where fn decides whether to retry explicitly
+//
+// fn returning (true, err) triggers a retry with err as the cause,
+// (false, err) ends the retry and err is returned to the caller.
+// (true, nil) triggers a retry without a cause.
+func DoBool(ctx context.Context, cfg Config, fn func(ctx context.Context) (retry bool, err error)) error {
+	return Do(ctx, cfg, func(ctx context.Context) error {
+		retry, err := fn(ctx)
+		if !retry {
+			return err
+		}
+		if err == nil {
+			err = errRetryRequested
+		}
+		return ErrRetry{err}
+	})
+}
+
+// DoUntil is a version of Do that retries until deadline
+//
+// It is similar to setting Timeout to the time remaining until deadline, but
+// ErrRestart does not extend it. If deadline has already passed, fn is not
+// called and context.DeadlineExceeded is returned.
+func DoUntil(ctx context.Context, cfg Config, deadline time.Time, fn func(ctx context.Context) error) error {
+	now, timeoutAfter := cfg.now, cfg.timeoutAfter
+	if now == nil {
+		now = time.Now
+	}
+	if timeoutAfter == nil {
+		timeoutAfter = time.After
+	}
+
+	ctx, cancel := withTimeout(ctx, deadline.Sub(now()), timeoutAfter, now)
+	defer cancel()
+	return Do(ctx, cfg, fn)
+}
+
+// Decision is a decision of the validator passed to Do1Validate
+type Decision int
+
+const (
+	// DecisionDone accepts the value and ends the retries
+	DecisionDone Decision = iota
+	// DecisionRetry retries as if fn returned ErrRetry
+	DecisionRetry
+	// DecisionRestart restarts as if fn returned ErrRestart, resetting both
+	// delay and timeout
+	DecisionRestart
+)
+
+// errRestartRequested is a cause of restart requested without an error
+var errRestartRequested = errors.New("restart requested")
+
+// Do1Validate is a version of Do1 where validate decides whether a value
+// returned without an error is accepted, or the retries go on
+//
+// validate is not called if fn returns an error, which is handled as in
+// Do1.
+func Do1Validate[T any](ctx context.Context, cfg Config, fn func(ctx context.Context) (T, error), validate func(T) Decision) (T, error) {
+	return Do1(ctx, cfg, func(ctx context.Context) (T, error) {
+		val, err := fn(ctx)
+		if err != nil {
+			return val, err
+		}
+		switch validate(val) {
+		case DecisionRetry:
+			return val, ErrRetry{errRetryRequested}
+		case DecisionRestart:
+			return val, ErrRestart{errRestartRequested}
+		default:
+			return val, nil
+		}
+	})
+}
+
+// Do1Fold is a version of Do1 that passes the value returned by the last
+// attempt to the next one
+//
+// The first attempt receives initial. Each following attempt receives the
+// value returned by the previous one, even if it failed, so fn can resume
+// from partial progress, e.g. from the last cursor. Do1Fold returns the
+// value returned by the last attempt.
+func Do1Fold[T any](ctx context.Context, cfg Config, initial T, fn func(ctx context.Context, prev T) (T, error)) (T, error) {
+	val := initial
+	err := Do(ctx, cfg, func(ctx context.Context) error {
+		var err error
+		val, err = fn(ctx, val)
+		return err
+	})
+	return val, err
+}
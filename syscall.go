@@ -0,0 +1,27 @@
+//go:build !plan9
+
+package retry
+
+import (
+	"errors"
+	"syscall"
+)
+
+// RetriableSyscall wraps the error in ErrRetry if it is a transient system
+// call error
+//
+// EAGAIN, EINTR, EBUSY and ETIMEDOUT, possibly wrapped (e.g. in
+// os.PathError), are considered transient. Other errors are returned
+// unchanged.
+func RetriableSyscall(err error) error {
+	var errno syscall.Errno
+	if !errors.As(err, &errno) {
+		return err
+	}
+	switch errno {
+	case syscall.EAGAIN, syscall.EINTR, syscall.EBUSY, syscall.ETIMEDOUT:
+		return ErrRetry{err}
+	default:
+		return err
+	}
+}
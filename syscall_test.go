@@ -0,0 +1,36 @@
+//go:build !plan9
+
+package retry
+
+import (
+	"errors"
+	"io/fs"
+	"syscall"
+	"testing"
+)
+
+func TestRetriableSyscall(t *testing.T) {
+	for _, tc := range []struct {
+		err       error
+		retriable bool
+	}{
+		{syscall.EAGAIN, true},
+		{syscall.EINTR, true},
+		{syscall.EBUSY, true},
+		{syscall.ETIMEDOUT, true},
+		{&fs.PathError{Op: "open", Path: "/mnt/nfs/file", Err: syscall.EAGAIN}, true},
+		{syscall.ENOENT, false},
+		{&fs.PathError{Op: "open", Path: "/mnt/nfs/file", Err: syscall.EACCES}, false},
+		{errors.New("not a syscall error"), false},
+		{nil, false},
+	} {
+		err := RetriableSyscall(tc.err)
+		var errRetry ErrRetry
+		if errors.As(err, &errRetry) != tc.retriable {
+			t.Errorf("RetriableSyscall(%v) was supposed to be retriable: %v, returned %#v", tc.err, tc.retriable, err)
+		}
+		if !errors.Is(err, tc.err) {
+			t.Errorf("RetriableSyscall(%v) was supposed to wrap the error, returned %#v", tc.err, err)
+		}
+	}
+}
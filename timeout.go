@@ -0,0 +1,85 @@
+package retry
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// timeoutCtx is a context cancelled once timeAfter fires, so that Timeout
+// can be driven by a fake clock in tests
+type timeoutCtx struct {
+	context.Context
+	deadline time.Time
+	done     chan struct{}
+	stop     chan struct{}
+	stopOnce sync.Once
+
+	mu  sync.Mutex
+	err error
+}
+
+// withTimeout is a version of context.WithTimeout driven by timeAfter and now
+func withTimeout(parent context.Context, timeout time.Duration, timeAfter func(time.Duration) <-chan time.Time, now func() time.Time) (context.Context, func()) {
+	ctx := &timeoutCtx{
+		Context:  parent,
+		deadline: now().Add(timeout),
+		done:     make(chan struct{}),
+		stop:     make(chan struct{}),
+	}
+	if err := parent.Err(); err != nil {
+		ctx.cancel(err)
+		return ctx, func() {}
+	}
+	if timeout <= 0 {
+		ctx.cancel(context.DeadlineExceeded)
+		return ctx, func() {}
+	}
+
+	// As with context.WithTimeout, the deadline of the parent, if earlier,
+	// cancels the context
+	var expired <-chan time.Time
+	if deadline, ok := parent.Deadline(); !ok || deadline.After(ctx.deadline) {
+		expired = timeAfter(timeout) // Doesn't leak since Go 1.23, https://github.com/golang/go/issues/8898
+	}
+	go func() {
+		select {
+		case <-parent.Done():
+			ctx.cancel(parent.Err())
+		case <-expired:
+			ctx.cancel(context.DeadlineExceeded)
+		case <-ctx.stop:
+			ctx.cancel(context.Canceled)
+		}
+	}()
+	return ctx, func() {
+		ctx.stopOnce.Do(func() { close(ctx.stop) })
+		// Make the context cancelled once the cancel function returns, as
+		// context.WithTimeout does
+		<-ctx.done
+	}
+}
+
+func (ctx *timeoutCtx) cancel(err error) {
+	ctx.mu.Lock()
+	ctx.err = err
+	ctx.mu.Unlock()
+	close(ctx.done)
+}
+
+func (ctx *timeoutCtx) Deadline() (time.Time, bool) {
+	if deadline, ok := ctx.Context.Deadline(); ok && deadline.Before(ctx.deadline) {
+		return deadline, true
+	}
+	return ctx.deadline, true
+}
+
+func (ctx *timeoutCtx) Done() <-chan struct{} {
+	return ctx.done
+}
+
+func (ctx *timeoutCtx) Err() error {
+	ctx.mu.Lock()
+	defer ctx.mu.Unlock()
+	return ctx.err
+}
@@ -0,0 +1,57 @@
+package retry
+
+import (
+	"context"
+	"slices"
+	"time"
+)
+
+// Attempt describes one call of the function retried by DoTrace
+type Attempt struct {
+	// Num is a number of the attempt, counted from 1 across restarts
+	Num int
+	// Err is an error returned by the function
+	Err error
+	// Started is a time when the attempt started
+	Started time.Time
+	// Duration is a time the attempt took
+	Duration time.Duration
+	// DelayBefore is a delay before the attempt, 0 for the first one
+	DelayBefore time.Duration
+}
+
+// Trace is a history of attempts made by DoTrace
+type Trace []Attempt
+
+// DoTrace is a version of Do that also returns the history of all attempts
+//
+// The trace is returned even if Do fails.
+func DoTrace(ctx context.Context, cfg Config, fn func(ctx context.Context) error) (Trace, error) {
+	now := cfg.now
+	if now == nil {
+		now = time.Now
+	}
+
+	var trace Trace
+	var delay time.Duration
+	// Middlewares see the final delay, so record it in the last one. Do not
+	// modify the caller's slice.
+	cfg.DelayMiddlewares = append(slices.Clip(cfg.DelayMiddlewares), func(_ int, d time.Duration) time.Duration {
+		delay = d
+		return d
+	})
+
+	err := Do(ctx, cfg, func(ctx context.Context) error {
+		started := now()
+		err := fn(ctx)
+		trace = append(trace, Attempt{
+			Num:         len(trace) + 1,
+			Err:         err,
+			Started:     started,
+			Duration:    now().Sub(started),
+			DelayBefore: delay,
+		})
+		return err
+	})
+	return trace, err
+}
@@ -0,0 +1,27 @@
+package retry
+
+import "context"
+
+// Wrap returns a function that calls fn with retries configured by cfg
+//
+// cfg is validated once, and Wrap panics if it is invalid. Each call of the
+// returned function retries independently, and the calls may be concurrent
+// as long as cfg allows concurrent use, e.g. does not share a Rand.
+func Wrap(cfg Config, fn func(ctx context.Context) error) func(ctx context.Context) error {
+	if err := cfg.Validate(); err != nil {
+		panic("retry: invalid config: " + err.Error())
+	}
+	return func(ctx context.Context) error {
+		return Do(ctx, cfg, fn)
+	}
+}
+
+// Wrap1 is a version of Wrap for functions with one return value
+func Wrap1[T any](cfg Config, fn func(ctx context.Context) (T, error)) func(ctx context.Context) (T, error) {
+	if err := cfg.Validate(); err != nil {
+		panic("retry: invalid config: " + err.Error())
+	}
+	return func(ctx context.Context) (T, error) {
+		return Do1(ctx, cfg, fn)
+	}
+}